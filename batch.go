@@ -0,0 +1,108 @@
+package bitcask
+
+import (
+	"encoding/binary"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/internal/index"
+)
+
+// Batch a group of puts and deletes written atomically by WriteBatch
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	mode  internal.Mode
+	key   []byte
+	value []byte
+}
+
+// NewBatch returns an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put add a put of key and value to batch
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		mode:  internal.ModePut,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+// Delete add a delete of key to batch
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{
+		mode: internal.ModeDelete,
+		key:  append([]byte(nil), key...),
+	})
+}
+
+// Len count of operations in batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset clear batch for reuse
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// WriteBatch Write all operations in batch atomically, either all or none of them
+// are visible after a crash.
+func (b *BitCask) WriteBatch(batch *Batch) error {
+	for _, op := range batch.ops {
+		if err := b.validKV(op.key, op.value); err != nil {
+			return err
+		}
+	}
+	return b.write(func() error {
+		return b.writeBatch(batch.ops)
+	})
+}
+
+// writeBatch 将批量记录写入同一个活跃文件并追加提交标记，提交标记落盘后才更新内存索引，调用方需持有写锁
+func (b *BitCask) writeBatch(ops []batchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := b.rotate(); err != nil {
+		return err
+	}
+	items := make([]internal.Item, len(ops))
+	for i, op := range ops {
+		seq := b.nextSeq()
+		pos, size, err := b.curr.Write(b.newEntry(op.key, op.value, op.mode|internal.ModeBatch, seq, 0))
+		if err != nil {
+			return err
+		}
+		items[i] = index.NewItem(b.curr.FileID(), pos, size)
+		items[i].Seq = seq
+	}
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(ops)))
+	commit := b.newEntry(nil, count, internal.ModeBatchCommit, b.nextSeq(), 0)
+	if _, _, err := b.curr.Write(commit); err != nil {
+		return err
+	}
+	if err := b.curr.Sync(); err != nil {
+		return err
+	}
+	fid := b.curr.FileID()
+	b.metadata.Append(fid, int64(commit.Size()), commit.Seq(), false)
+	for i, op := range ops {
+		b.metadata.Append(fid, int64(items[i].ValueSize), items[i].Seq, op.mode == internal.ModePut)
+		b.reclaimDetect(op.key)
+		if op.mode == internal.ModeDelete {
+			b.indexer.Delete(op.key)
+			continue
+		}
+		b.indexer.Add(op.key, items[i])
+	}
+	return nil
+}
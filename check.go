@@ -0,0 +1,404 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	idx "github.com/zach030/tiny-bitcask/internal/index"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+// ProblemKind kind of problem found by Check
+type ProblemKind int
+
+const (
+	ProblemCorrupt  ProblemKind = iota // bytes of datafile that do not decode to an intact record
+	ProblemOrphaned                    // intact record no index refers to: uncommitted batch record, or record of merged datafile missing from its hint file
+	ProblemDangling                    // hint entry without a matching record in datafile
+	ProblemBadHint                     // hint file that can not be read or whose datafile does not exist
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemCorrupt:
+		return "corrupt"
+	case ProblemOrphaned:
+		return "orphaned"
+	case ProblemDangling:
+		return "dangling"
+	case ProblemBadHint:
+		return "bad-hint"
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem a corrupt region, orphaned record or inconsistent hint found by Check
+type Problem struct {
+	Kind   ProblemKind
+	FileID int
+	Offset int64  // offset in datafile, or of the record the hint entry points to
+	Size   int64  // bytes of the region or record
+	Key    []byte // key of the record or hint entry, nil for corrupt region
+	Err    error  // cause of corrupt region and bad hint file
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%v: datafile %d offset %d size %d", p.Kind, p.FileID, p.Offset, p.Size)
+	if p.Key != nil {
+		s += fmt.Sprintf(" key %q", p.Key)
+	}
+	if p.Err != nil {
+		s += fmt.Sprintf(": %v", p.Err)
+	}
+	return s
+}
+
+// CheckReport result of Check and Repair
+type CheckReport struct {
+	Files       int       // datafiles checked
+	Records     int       // intact records
+	Hints       int       // hint entries
+	Problems    []Problem // problems in order of datafile id and offset
+	Quarantined int64     // bytes moved out of datafiles by Repair
+	Rebuilt     []int     // datafiles whose hint file is removed by Repair, their index is rebuilt from records
+}
+
+// OK if no problem is found
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// fileCheck 单个数据文件的检查结果，修复时据此隔离记录、删除hint文件
+type fileCheck struct {
+	fid        int
+	quarantine []Problem // 需要移出数据文件的区域：损坏的区域与未提交的批量记录
+	badHint    bool      // hint文件与数据文件不一致
+}
+
+// Check verify a closed database offline: every record of datafiles is decoded and its checksum
+// verified, batch records are matched with their commit, and every hint file is cross-checked
+// against its datafile. The directory is locked shared, so it fails if the database is opened
+// writable. Check does not modify the directory.
+func Check(path string) (*CheckReport, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	fl, err := lockDir(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if fl != nil {
+		defer fl.Release()
+	}
+	// 合并切换到一半时目录中同时存在新旧文件，需要读写打开完成切换
+	if utils.Exist(filepath.Join(path, MergeTmpFolder, MergeManifest)) {
+		return nil, ErrMergeInterrupted
+	}
+	// 最初版本的记录格式不同，需要读写打开升级后再检查
+	if v0, err := isV0(path); err != nil || v0 {
+		if err == nil {
+			err = ErrUpgradeRequired
+		}
+		return nil, err
+	}
+	report, _, err := check(path)
+	return report, err
+}
+
+// Repair fix the problems Check reports: corrupt regions and uncommitted batch records are moved
+// out of datafiles into the quarantine folder, and hint files inconsistent with their datafile are
+// removed. The database is then opened with options to rebuild its index and closed again.
+// Databases of the original format are left untouched and ErrUpgradeRequired is returned.
+func Repair(path string, options ...Option) (*CheckReport, error) {
+	var cfg = *DefaultConfig
+	for _, option := range options {
+		if err := option(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	fl, err := lockDir(path, false)
+	if err != nil {
+		return nil, err
+	}
+	// 最初版本的记录会被当作损坏隔离，需要先读写打开升级
+	if v0, err := isV0(path); err != nil || v0 {
+		fl.Release()
+		if err == nil {
+			err = ErrUpgradeRequired
+		}
+		return nil, err
+	}
+	report, err := repair(path, &cfg)
+	fl.Release()
+	if err != nil {
+		return nil, err
+	}
+	db, err := Open(path, options...)
+	if err != nil {
+		return nil, err
+	}
+	return report, db.Close()
+}
+
+// repair 先完成中断的合并，再检查并修复，调用方需持有目录锁
+func repair(path string, cfg *Config) (*CheckReport, error) {
+	b := &BitCask{path: path, config: cfg}
+	if err := b.recoverMerge(); err != nil {
+		return nil, err
+	}
+	report, files, err := check(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(path, QuarantineDir, time.Now().Format("20060102-150405.000"))
+	for _, fc := range files {
+		if len(fc.quarantine) > 0 {
+			n, err := quarantine(path, dir, fc)
+			if err != nil {
+				return nil, err
+			}
+			report.Quarantined += n
+			// 记录的位置发生了变化
+			fc.badHint = true
+		}
+		if !fc.badHint {
+			continue
+		}
+		if err = os.Remove(hintPath(path, fc.fid)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		report.Rebuilt = append(report.Rebuilt, fc.fid)
+	}
+	return report, utils.SyncDir(path)
+}
+
+// check 检查目录中的每个数据文件与hint文件
+func check(path string) (*CheckReport, []*fileCheck, error) {
+	fns, err := utils.GetDataFiles(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fids, err := utils.GetDataFileIDs(fns)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Ints(fids)
+	report := &CheckReport{Files: len(fids)}
+	exist := make(map[int]bool, len(fids))
+	var files []*fileCheck
+	for _, fid := range fids {
+		exist[fid] = true
+		fc, err := checkFile(path, fid, report)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, fc)
+	}
+	// 没有对应数据文件的hint文件
+	hints, err := filepath.Glob(filepath.Join(path, "*"+filepath.Ext(idx.DefaultHintFileName)))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fp := range hints {
+		if fid, ok := utils.ParseFileID(filepath.Base(fp)); ok && !exist[fid] {
+			report.Problems = append(report.Problems, Problem{Kind: ProblemBadHint, FileID: fid, Err: ErrDatabaseNotExist})
+			files = append(files, &fileCheck{fid: fid, badHint: true})
+		}
+	}
+	return report, files, nil
+}
+
+// checkedRecord 校验通过的记录
+type checkedRecord struct {
+	entry  *internal.Entry
+	offset int64
+	size   int
+}
+
+// checkFile 逐条解析数据文件，损坏的区域与未提交的批量记录计入问题；存在hint文件时交叉检查
+func checkFile(path string, fid int, report *CheckReport) (*fileCheck, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(path, fmt.Sprintf("%v%v", fid, DataFileExt)))
+	if err != nil {
+		return nil, err
+	}
+	fc := &fileCheck{fid: fid}
+	records := make(map[int64]checkedRecord)
+	var pending []checkedRecord
+	orphan := func() {
+		for _, r := range pending {
+			fc.quarantine = append(fc.quarantine, Problem{Kind: ProblemOrphaned, FileID: fid, Offset: r.offset, Size: int64(r.size), Key: r.entry.Key()})
+		}
+		pending = pending[:0]
+	}
+	var offset int64
+	for offset < int64(len(buf)) {
+		e, size, err := decodeRecord(buf, offset)
+		if err != nil {
+			// 损坏的区域中可能有批量记录，之前暂存的批量记录不再与之后的提交标记相邻
+			orphan()
+			next := resync(buf, offset+1)
+			fc.quarantine = append(fc.quarantine, Problem{Kind: ProblemCorrupt, FileID: fid, Offset: offset, Size: next - offset, Err: err})
+			offset = next
+			continue
+		}
+		r := checkedRecord{entry: e, offset: offset, size: size}
+		offset += int64(size)
+		switch mode := e.Mode(); {
+		case mode.InBatch():
+			pending = append(pending, r)
+			continue
+		case mode == internal.ModeBatchCommit:
+			// 与重放一致：提交标记只对紧挨着它的n条记录生效
+			n := int(binary.LittleEndian.Uint32(e.Value()))
+			if n > len(pending) {
+				orphan()
+				fc.quarantine = append(fc.quarantine, Problem{Kind: ProblemCorrupt, FileID: fid, Offset: r.offset, Size: int64(size), Err: ErrInvalidBatch})
+				continue
+			}
+			committed := pending[len(pending)-n:]
+			pending = pending[:len(pending)-n]
+			orphan()
+			for _, c := range committed {
+				records[c.offset] = c
+			}
+		default:
+			orphan()
+		}
+		records[r.offset] = r
+	}
+	orphan()
+	sort.Slice(fc.quarantine, func(i, j int) bool {
+		return fc.quarantine[i].Offset < fc.quarantine[j].Offset
+	})
+	report.Records += len(records)
+	report.Problems = append(report.Problems, fc.quarantine...)
+	if err = checkHint(path, fc, records, report); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// checkHint hint文件中的每一项都要指向键、序号与类型一致的记录，数据文件中的每条记录也都要出现在hint文件中
+func checkHint(path string, fc *fileCheck, records map[int64]checkedRecord, report *CheckReport) error {
+	f, err := os.Open(hintPath(path, fc.fid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var problems []Problem
+	referred := make(map[int64]bool)
+	err = idx.ReadHints(f, stat.Size(), fc.fid, func(key []byte, item internal.Item) error {
+		report.Hints++
+		tombstone := idx.IsTombstone(item)
+		if tombstone {
+			item.ValueSize = internal.EntryHeaderSize + len(key)
+		}
+		r, ok := records[item.ValuePos]
+		if !ok || r.size != item.ValueSize || !bytes.Equal(r.entry.Key(), key) || r.entry.Seq() != item.Seq ||
+			(r.entry.Mode() == internal.ModeDelete) != tombstone || r.entry.ExpiredAt() != item.ExpiredAt {
+			problems = append(problems, Problem{Kind: ProblemDangling, FileID: fc.fid, Offset: item.ValuePos, Size: int64(item.ValueSize), Key: key})
+			return nil
+		}
+		referred[item.ValuePos] = true
+		return nil
+	})
+	if err != nil {
+		report.Problems = append(report.Problems, Problem{Kind: ProblemBadHint, FileID: fc.fid, Err: err})
+		fc.badHint = true
+		return nil
+	}
+	for offset, r := range records {
+		if !referred[offset] {
+			problems = append(problems, Problem{Kind: ProblemOrphaned, FileID: fc.fid, Offset: offset, Size: int64(r.size), Key: r.entry.Key()})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Offset < problems[j].Offset
+	})
+	report.Problems = append(report.Problems, problems...)
+	fc.badHint = fc.badHint || len(problems) > 0
+	return nil
+}
+
+// decodeRecord 解析offset处的记录，记录不完整、头部损坏、校验失败或类型未知时返回错误
+func decodeRecord(buf []byte, offset int64) (*internal.Entry, int, error) {
+	if int64(len(buf))-offset < internal.EntryHeaderSize {
+		return nil, 0, ErrTruncatedEntry
+	}
+	keySize, valueSize := internal.DecodeHeader(buf[offset:])
+	size := uint64(internal.EntryHeaderSize) + uint64(keySize) + uint64(valueSize)
+	if size > uint64(int64(len(buf))-offset) {
+		return nil, 0, ErrTruncatedEntry
+	}
+	e, err := internal.Decode(buf[offset : offset+int64(size)])
+	if err != nil {
+		return nil, 0, err
+	}
+	if !e.IsValid() {
+		return nil, 0, ErrInvalidCheckSum
+	}
+	switch mode := e.Mode(); {
+	case mode == internal.ModeBatchCommit:
+		if len(e.Value()) != 4 {
+			return nil, 0, ErrInvalidBatch
+		}
+	case mode.Op() != internal.ModePut && mode.Op() != internal.ModeDelete:
+		return nil, 0, ErrUnknownMode
+	}
+	return e, int(size), nil
+}
+
+// resync 损坏区域中的大小字段不可信，从from开始逐字节寻找下一条完整的记录，找不到时返回文件末尾
+func resync(buf []byte, from int64) int64 {
+	for offset := from; offset < int64(len(buf)); offset++ {
+		if _, _, err := decodeRecord(buf, offset); err == nil {
+			return offset
+		}
+	}
+	return int64(len(buf))
+}
+
+// quarantine 将需要隔离的区域写入隔离目录，其余记录写入临时文件后替换数据文件，返回移出的字节数
+func quarantine(path, dir string, fc *fileCheck) (int64, error) {
+	fp := filepath.Join(path, fmt.Sprintf("%v%v", fc.fid, DataFileExt))
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	var kept []byte
+	var n, offset int64
+	for _, p := range fc.quarantine {
+		kept = append(kept, buf[offset:p.Offset]...)
+		name := filepath.Join(dir, fmt.Sprintf("%v-%v.bad", fc.fid, p.Offset))
+		if err = ioutil.WriteFile(name, buf[p.Offset:p.Offset+p.Size], 0600); err != nil {
+			return 0, err
+		}
+		n += p.Size
+		offset = p.Offset + p.Size
+	}
+	kept = append(kept, buf[offset:]...)
+	if err = utils.SyncDir(dir); err != nil {
+		return 0, err
+	}
+	return n, utils.WriteFileAtomic(fp, kept, 0640)
+}
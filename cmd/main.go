@@ -1,24 +1,542 @@
+// Command bitcask inspects and modifies a database directory.
+//
+//	bitcask [--dir path] <command> [flags] [args]
+//
+// Commands reading data open the database read-only, so they can run alongside other readers
+// but not alongside a writer.
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"time"
+
 	bitcask "github.com/zach030/tiny-bitcask"
-	"log"
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/utils"
 )
 
+// command a subcommand, run parses its own flags from args
+type command struct {
+	usage string
+	help  string
+	run   func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"get":    {"get KEY", "print the value of KEY", get},
+	"put":    {"put [-ttl d] [-file f] KEY [VALUE]", "store VALUE, the content of f, or stdin under KEY", put},
+	"delete": {"delete KEY...", "delete keys", del},
+	"keys":   {"keys [-prefix p]", "list keys in order", keys},
+	"scan":   {"scan [-prefix p] [-start k] [-end k] [-reverse] [-limit n]", "print keys and values in order", scan},
+	"stats":  {"stats", "print key count and datafile usage", stats},
+	"merge":  {"merge [-ratio r]", "compact datafiles whose ratio of stale bytes reaches r", merge},
+	"dump":   {"dump [-values] [FILEID...]", "print every record of datafiles, including stale ones", dump},
+	"export": {"export [-prefix p] [-o file]", "write live keys and values as JSON lines", export},
+	"load":   {"load [FILE]", "put keys and values from JSON lines written by export, stdin by default", load},
+	"check":  {"check", "verify datafiles and hint files offline, exit status 1 on problems", check},
+	"repair": {"repair", "quarantine corrupt records and rebuild index", repair},
+}
+
+// errProblems check found problems, exit status is 1 without further message
+var errProblems = errors.New("problems found")
+
+var dir = flag.String("dir", "data", "database directory")
+
 func main() {
-	db, err := bitcask.Open("data", nil)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "bitcask: unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	// --dir is accepted after the command as well
+	fs.StringVar(dir, "dir", *dir, "database directory")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: bitcask [--dir path] %s\n\n%s\n", cmd.usage, cmd.help)
+		fs.PrintDefaults()
+	}
+	err := cmd.run(fs, flag.Args()[1:])
+	switch {
+	case err == errProblems:
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "bitcask %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bitcask [--dir path] <command> [flags] [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// open opens the database with the limits it was created with
+func open(readOnly bool) (*bitcask.BitCask, error) {
+	cfg, err := bitcask.LoadConfig(*dir)
+	if err != nil {
+		return nil, err
+	}
+	opts := []bitcask.Option{bitcask.WithConfig(cfg), bitcask.WithSweepInterval(0)}
+	if readOnly {
+		opts = append(opts, bitcask.WithReadOnly())
+	}
+	return bitcask.Open(*dir, opts...)
+}
+
+// parse parses flags and checks the count of positional arguments, max < 0 means no limit
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	fs.Parse(args)
+	if n := fs.NArg(); n < min || (max >= 0 && n > max) {
+		fs.Usage()
+		return fmt.Errorf("%d arguments given", n)
+	}
+	return nil
+}
+
+func get(fs *flag.FlagSet, args []string) error {
+	raw := fs.Bool("raw", false, "print the value without trailing newline")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	db, err := open(true)
+	if err != nil {
+		return err
+	}
 	defer db.Close()
+	val, err := db.Get([]byte(fs.Arg(0)))
 	if err != nil {
-		return
+		return err
+	}
+	os.Stdout.Write(val)
+	if !*raw {
+		fmt.Println()
+	}
+	return nil
+}
+
+func put(fs *flag.FlagSet, args []string) error {
+	ttl := fs.Duration("ttl", 0, "expire the key after ttl, 0 means never")
+	file := fs.String("file", "", "read the value from file")
+	if err := parse(fs, args, 1, 2); err != nil {
+		return err
 	}
-	err = db.Put([]byte("key1"), []byte("value"))
+	var val []byte
+	var err error
+	switch {
+	case fs.NArg() == 2 && *file != "":
+		return errors.New("both VALUE and -file given")
+	case fs.NArg() == 2:
+		val = []byte(fs.Arg(1))
+	case *file != "":
+		val, err = ioutil.ReadFile(*file)
+	default:
+		val, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	db, err := open(false)
+	if err != nil {
+		return err
+	}
+	if *ttl > 0 {
+		err = db.PutWithTTL([]byte(fs.Arg(0)), val, *ttl)
+	} else {
+		err = db.Put([]byte(fs.Arg(0)), val)
+	}
+	if err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func del(fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	db, err := open(false)
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	for _, key := range fs.Args() {
+		if err = db.Delete([]byte(key)); err != nil {
+			db.Close()
+			return err
+		}
 	}
-	val, err := db.Get([]byte("key1"))
+	return db.Close()
+}
+
+func keys(fs *flag.FlagSet, args []string) error {
+	prefix := fs.String("prefix", "", "only list keys with the prefix")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	db, err := open(true)
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	defer db.Close()
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	return db.Scan([]byte(*prefix), func(key []byte) error {
+		w.Write(key)
+		return w.WriteByte('\n')
+	})
+}
+
+func scan(fs *flag.FlagSet, args []string) error {
+	prefix := fs.String("prefix", "", "only print keys with the prefix")
+	start := fs.String("start", "", "first key to print")
+	end := fs.String("end", "", "stop before this key, empty means no upper bound")
+	reverse := fs.Bool("reverse", false, "print keys in descending order")
+	limit := fs.Int("limit", 0, "print at most n keys, 0 means no limit")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	db, err := open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	it := db.NewIterator(bitcask.IteratorOptions{Prefix: []byte(*prefix), Reverse: *reverse})
+	defer it.Close()
+	if *start != "" {
+		it.Seek([]byte(*start))
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for n := 0; it.Valid() && (*limit == 0 || n < *limit); it.Next() {
+		key := string(it.Key())
+		if *end != "" && (!*reverse && key >= *end || *reverse && key <= *end) {
+			break
+		}
+		val, err := it.Value()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\n", key, val)
+		n++
+	}
+	return nil
+}
+
+func stats(fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	db, err := open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	s := db.Stats()
+	fmt.Printf("keys:        %d\n", s.Keys)
+	fmt.Printf("datafiles:   %d\n", s.DataFiles)
+	fmt.Printf("size:        %d\n", s.Size)
+	fmt.Printf("dead bytes:  %d\n", s.DeadBytes)
+	fmt.Printf("reclaimable: %d\n", s.Reclaimable)
+	fmt.Printf("seq:         %d\n", s.Seq)
+	return nil
+}
+
+func merge(fs *flag.FlagSet, args []string) error {
+	ratio := fs.Float64("ratio", 0, "merge datafiles whose ratio of stale bytes reaches it, 0 keeps the default")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	cfg, err := bitcask.LoadConfig(*dir)
+	if err != nil {
+		return err
+	}
+	opts := []bitcask.Option{bitcask.WithConfig(cfg), bitcask.WithSweepInterval(0),
+		bitcask.WithMergeProgress(func(p bitcask.MergeProgress) {
+			if p.Done {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "merged %d/%d datafiles, %d keys rewritten, %d bytes reclaimed\n",
+				p.FilesProcessed, p.FilesTotal, p.KeysRewritten, p.BytesReclaimed)
+		})}
+	if *ratio > 0 {
+		opts = append(opts, bitcask.WithMergeRatio(*ratio))
+	}
+	db, err := bitcask.Open(*dir, opts...)
+	if err != nil {
+		return err
+	}
+	// interrupt cancels the merge, the database is left as before
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err = db.Merge(ctx); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func dump(fs *flag.FlagSet, args []string) error {
+	values := fs.Bool("values", false, "print values as well")
+	if err := parse(fs, args, 0, -1); err != nil {
+		return err
+	}
+	var fids []int
+	for _, arg := range fs.Args() {
+		var fid int
+		if _, err := fmt.Sscan(arg, &fid); err != nil {
+			return fmt.Errorf("invalid file id %q", arg)
+		}
+		fids = append(fids, fid)
+	}
+	if len(fids) == 0 {
+		fns, err := utils.GetDataFiles(*dir)
+		if err != nil {
+			return err
+		}
+		if fids, err = utils.GetDataFileIDs(fns); err != nil {
+			return err
+		}
+		sort.Ints(fids)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintln(w, "file\toffset\tsize\tseq\tmode\texpired-at\tvalid\tkey\tvalue")
+	for _, fid := range fids {
+		if err := dumpFile(w, fid, *values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpFile prints records of a datafile in order, it stops at the first record that can not be
+// decoded, check reports the records after it
+func dumpFile(w io.Writer, fid int, values bool) error {
+	buf, err := ioutil.ReadFile(filepath.Join(*dir, fmt.Sprintf("%v%v", fid, bitcask.DataFileExt)))
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(buf); {
+		e, err := decodeAt(buf, offset)
+		if err != nil {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%v\n", fid, offset, len(buf)-offset, err)
+			return nil
+		}
+		expiredAt := "-"
+		if e.ExpiredAt() > 0 {
+			expiredAt = time.Unix(0, e.ExpiredAt()).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\t%s\t%v\t%q", fid, offset, e.Size(), e.Seq(), modeName(e.Mode()), expiredAt, e.IsValid(), e.Key())
+		if values {
+			fmt.Fprintf(w, "\t%q", e.Value())
+		}
+		fmt.Fprintln(w)
+		offset += e.Size()
+	}
+	return nil
+}
+
+// decodeAt decodes the record at offset, the record size is taken from its header
+func decodeAt(buf []byte, offset int) (*internal.Entry, error) {
+	if len(buf)-offset < internal.EntryHeaderSize {
+		return nil, internal.ErrTruncatedEntry
+	}
+	keySize, valueSize := internal.DecodeHeader(buf[offset:])
+	size := uint64(internal.EntryHeaderSize) + uint64(keySize) + uint64(valueSize)
+	if size > uint64(len(buf)-offset) {
+		return nil, internal.ErrTruncatedEntry
+	}
+	return internal.Decode(buf[offset : offset+int(size)])
+}
+
+func modeName(m internal.Mode) string {
+	var name string
+	switch m.Op() {
+	case internal.ModePut:
+		name = "put"
+	case internal.ModeDelete:
+		name = "delete"
+	case internal.ModeBatchCommit:
+		name = "commit"
+	default:
+		name = fmt.Sprintf("mode(%d)", m.Op())
+	}
+	if m.InBatch() {
+		name += "+batch"
+	}
+	return name
+}
+
+// record line of export and load, key and value are base64 encoded by encoding/json
+type record struct {
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiredAt int64  `json:"expired_at,omitempty"` // unix nano, absent if the key never expires
+}
+
+func export(fs *flag.FlagSet, args []string) error {
+	prefix := fs.String("prefix", "", "only export keys with the prefix")
+	out := fs.String("o", "", "write to file instead of stdout")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	db, err := open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	f := os.Stdout
+	if *out != "" {
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	it := db.NewIterator(bitcask.IteratorOptions{Prefix: []byte(*prefix)})
+	defer it.Close()
+	now := time.Now()
+	for ; it.Valid(); it.Next() {
+		r := record{Key: it.Key()}
+		if r.Value, err = it.Value(); err != nil {
+			return err
+		}
+		ttl, err := db.TTL(r.Key)
+		if errors.Is(err, bitcask.ErrSpecifyKeyNotExist) {
+			// expired during export
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ttl >= 0 {
+			r.ExpiredAt = now.Add(ttl).UnixNano()
+		}
+		if err = enc.Encode(&r); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if *out != "" {
+		return f.Sync()
+	}
+	return nil
+}
+
+func load(fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	db, err := open(false)
+	if err != nil {
+		return err
+	}
+	var n, expired int
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec record
+		if err = dec.Decode(&rec); err == io.EOF {
+			break
+		}
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("record %d: %v", n+expired+1, err)
+		}
+		switch ttl := time.Until(time.Unix(0, rec.ExpiredAt)); {
+		case rec.ExpiredAt == 0:
+			err = db.Put(rec.Key, rec.Value)
+		case ttl > 0:
+			err = db.PutWithTTL(rec.Key, rec.Value, ttl)
+		default:
+			expired++
+			continue
+		}
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("record %d: %v", n+expired+1, err)
+		}
+		n++
+	}
+	fmt.Fprintf(os.Stderr, "%d keys loaded, %d expired keys skipped\n", n, expired)
+	return db.Close()
+}
+
+func check(fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	report, err := bitcask.Check(*dir)
+	if err != nil {
+		return err
+	}
+	printReport(report)
+	if !report.OK() {
+		return errProblems
+	}
+	return nil
+}
+
+func repair(fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	cfg, err := bitcask.LoadConfig(*dir)
+	if err != nil {
+		return err
+	}
+	report, err := bitcask.Repair(*dir, bitcask.WithConfig(cfg), bitcask.WithSweepInterval(0))
+	if err != nil {
+		return err
+	}
+	printReport(report)
+	fmt.Printf("%d bytes quarantined, index rebuilt for datafiles %v\n", report.Quarantined, report.Rebuilt)
+	return nil
+}
+
+func printReport(report *bitcask.CheckReport) {
+	for _, p := range report.Problems {
+		fmt.Println(p)
 	}
-	fmt.Println("value is:", string(val))
+	fmt.Printf("%d datafiles, %d records, %d hint entries, %d problems\n",
+		report.Files, report.Records, report.Hints, len(report.Problems))
 }
@@ -1,17 +1,57 @@
 package bitcask
 
+import (
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/internal/index"
+)
+
+// IndexType kind of memory index
+type IndexType = index.Type
+
+const (
+	HashIndex    = index.TypeHash     // 哈希索引，有序遍历时需要先排序全部key
+	OrderedIndex = index.TypeSkipList // 有序索引，支持前缀、范围及逆序遍历
+)
+
+// ChecksumType algorithm of record checksum
+type ChecksumType = internal.Checksum
+
+const (
+	ChecksumIEEE   = internal.ChecksumIEEE   // crc32 IEEE多项式
+	ChecksumCRC32C = internal.ChecksumCRC32C // crc32 Castagnoli多项式，多数CPU有硬件加速
+)
+
 var DefaultConfig = &Config{
 	MaxFileSize:     2 << 10,
 	MaxKeySize:      2 << 5,
 	MaxValueSize:    2 << 6,
-	Sync:            false,
-	MaxReclaimSpace: 2 << 6,
+	SyncMode:        SyncNone,
+	SyncInterval:    time.Second,
+	GroupCommitWait: time.Millisecond,
+	MergePolicy: MergePolicy{
+		MinGarbageRatio: 0.5,
+		MinDeadBytes:    1 << 20,
+		Cooldown:        time.Minute,
+	},
+	SweepInterval: time.Minute,
+	IndexType:     HashIndex,
+	Checksum:      ChecksumIEEE,
 }
 
 type Config struct {
-	MaxFileSize     int64  // 每个文件最大值
-	MaxKeySize      uint32 // key最大值
-	MaxValueSize    uint64 // value最大值
-	Sync            bool   // 是否强制落盘
-	MaxReclaimSpace int64  // 需要merge的冗余上限
+	MaxFileSize     int64               // 每个文件最大值
+	MaxKeySize      uint32              // key最大值
+	MaxValueSize    uint64              // value最大值
+	SyncMode        SyncMode            // 落盘模式，见SyncMode各取值的保证
+	SyncInterval    time.Duration       // SyncPeriodic模式下后台落盘的间隔
+	GroupCommitWait time.Duration       // SyncGroup模式下等待其他写入者加入同一次fsync的最长时间
+	MergePolicy     MergePolicy         // 合并的调度策略
+	SweepInterval   time.Duration       // 后台清理过期key的间隔，为0时不启动
+	IndexType       IndexType           // 内存索引类型
+	Checksum        ChecksumType        // 新写入记录的校验算法，记录自带算法标志，已有数据不受影响
+	ReadOnly        bool                // 只读打开，持有共享目录锁，拒绝写入且不修改目录
+	MergeProgress   func(MergeProgress) // 合并进度回调，后台合并的错误也通过它报告
+	OnRecover       func(TailRecovery)  // 打开时截断活跃文件末尾不完整记录的回调，为空时写入日志
 }
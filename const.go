@@ -1,8 +1,12 @@
 package bitcask
 
 const (
-	DataFileExt    = ".data"     // 数据文件后缀
-	IndexFile      = "index"     // 索引文件名
-	IndexTmpName   = "index-tmp" // 临时索引文件名
-	MergeTmpFolder = "merge"     // 临时合并文件夹名
+	DataFileExt    = ".data"      // 数据文件后缀
+	IndexFile      = "index"      // 旧版本的索引文件名，已由每个数据文件的hint文件取代
+	MergeTmpFolder = "merge"      // 临时合并文件夹名
+	MergeManifest  = "MANIFEST"   // 合并清单文件名，合并结果完整落盘后写入
+	SeqFile        = "seq"        // 旧版本持久化最大写入序号的文件名，已由元数据文件取代
+	MetaFile       = "META"       // 元数据文件名，记录格式版本、创建时的配置、文件统计与最大写入序号
+	LockFile       = "LOCK"       // 目录锁文件名，记录持有者的pid
+	QuarantineDir  = "quarantine" // 修复时隔离损坏记录的文件夹名
 )
@@ -1,14 +1,20 @@
 package bitcask
 
 import (
-	"io/ioutil"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/zach030/tiny-bitcask/internal"
 	df "github.com/zach030/tiny-bitcask/internal/datafile"
+	"github.com/zach030/tiny-bitcask/internal/flock"
 	"github.com/zach030/tiny-bitcask/internal/index"
 	idx "github.com/zach030/tiny-bitcask/internal/index"
 	"github.com/zach030/tiny-bitcask/utils"
@@ -22,91 +28,415 @@ type BitCask struct {
 	dataFiles map[int]df.DataFile
 	options   []Option
 	config    *Config
-	metadata  *internal.MetaData //todo 存放当前冗余大小，需要落盘元数据存储
-	isMerging bool               // 是否在合并
+	metadata  *internal.MetaData // 每个数据文件的有效与无效字节数，关闭时落盘
+	meta      *dbMeta            // 持久化的元数据
+	merging   int32              // 是否在合并，原子操作
+	mergeLock sync.Mutex         // 合并期间持有，关闭时等待进行中的合并结束
+	lastMerge int64              // 上一次合并结束的时间(unix nano)，原子操作
 	needMerge chan struct{}      // 是否需要合并，实时检测reclaim大小
+	seq       uint64             // 最近一次写入的序号，用于事务冲突检测
+	pins      map[int]int        // 被快照引用的数据文件id及引用计数，被引用的文件不参与合并
+	flock     *flock.Flock       // 目录锁，防止多个进程同时打开
+	writes    chan *writeReq     // 写入管道，合并并发的Put/Delete请求
+	done      chan struct{}      // 关闭时通知后台协程退出
+	closed    int32              // 是否已关闭，原子操作
 }
 
 // Open database
 func Open(path string, options ...Option) (*BitCask, error) {
-	var cfg = DefaultConfig
+	db, err := open(path, options...)
+	if err != nil {
+		return nil, err
+	}
+	// 只读模式不会产生待回收空间，不启动合并与清理协程
+	if !db.config.ReadOnly {
+		db.start()
+	}
+	return db, nil
+}
+
+// open 打开数据库并重建索引，不启动后台协程
+func open(path string, options ...Option) (*BitCask, error) {
+	var cfg = *DefaultConfig
 	for _, option := range options {
-		if err := option(cfg); err != nil {
+		if err := option(&cfg); err != nil {
 			return nil, err
 		}
 	}
-	err := os.MkdirAll(path, 0700)
+	fl, err := lockDir(path, cfg.ReadOnly)
 	if err != nil {
 		return nil, err
 	}
 	db := &BitCask{
 		path:      path,
-		config:    cfg,
+		config:    &cfg,
 		options:   options,
-		metadata:  &internal.MetaData{ReclaimSpace: 0},
+		metadata:  internal.NewMetaData(),
 		needMerge: make(chan struct{}, 1),
-		isMerging: false,
+		pins:      make(map[int]int),
+		flock:     fl,
+		writes:    make(chan *writeReq),
+		done:      make(chan struct{}),
+	}
+	if err = db.recoverMerge(); err != nil {
+		db.unlockDir()
+		return nil, err
+	}
+	if err = db.loadMeta(); err != nil {
+		db.unlockDir()
+		return nil, err
 	}
 	err = db.rebuild()
 	if err != nil {
+		db.unlockDir()
+		return nil, err
+	}
+	if cfg.ReadOnly {
+		return db, nil
+	}
+	// 标记为未正常关闭，宕机后重新打开时重新统计
+	if err = db.saveMeta(false); err != nil {
+		db.closeFiles()
+		db.unlockDir()
 		return nil, err
 	}
-	go db.stat()
 	return db, nil
 }
 
-func (b *BitCask) stat() {
-	for {
-		select {
-		case _, ok := <-b.needMerge:
-			if !ok {
-				return
-			}
-			if err := b.merge(); err != nil {
-				return
-			}
+// start 启动合并检测、写入管道、过期清理与落盘协程
+func (b *BitCask) start() {
+	go b.stat()
+	go b.pipeline()
+	if b.config.SweepInterval > 0 {
+		go b.sweep()
+	}
+	if b.config.SyncMode == SyncPeriodic {
+		go b.syncLoop()
+	}
+}
+
+// lockDir 创建目录并加锁，只读模式要求目录已存在并使用共享锁，允许多个只读进程同时打开
+func lockDir(path string, readOnly bool) (*flock.Flock, error) {
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
 		}
+	} else if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(path, LockFile)
+	fl, err := flock.New(lockPath, readOnly)
+	switch {
+	case err == flock.ErrLocked:
+		return nil, &ErrDatabaseLocked{Path: path, PID: flock.Owner(lockPath)}
+	case readOnly && os.IsNotExist(err):
+		// 只读模式不创建锁文件，目录从未以读写模式打开过时不加锁
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return fl, nil
+}
+
+// unlockDir 释放目录锁
+func (b *BitCask) unlockDir() error {
+	if b.flock == nil {
+		return nil
 	}
+	return b.flock.Release()
 }
 
-// rebuild load from bitcask.hint datafile to build index
+// rebuild load hint files and datafiles to build index
 func (b *BitCask) rebuild() (err error) {
 	dfs, last, err := loadDataFiles(b.path)
 	if err != nil {
 		return
 	}
-	idx, err := loadIndexes(b.path)
-	if err != nil {
+	b.dataFiles = dfs
+	b.indexer = index.New(b.config.IndexType)
+	// 上次宕机时活跃文件末尾的记录可能只写了一部分，合并产生的文件不会被追加写入
+	if !b.config.ReadOnly && len(dfs) > 0 && !utils.Exist(hintPath(b.path, last)) {
+		if err = b.recoverTail(dfs[last]); err != nil {
+			return
+		}
+	}
+	if err = b.loadIndexes(); err != nil {
 		return
 	}
+	// 只读模式不创建活跃文件，最后一个数据文件作为只读的当前文件
+	if b.config.ReadOnly {
+		if len(dfs) == 0 {
+			return ErrDatabaseNotExist
+		}
+		b.curr = dfs[last]
+		delete(b.dataFiles, last)
+		return
+	}
+	// 带有hint文件的数据文件是合并产生的，不再追加写入
+	if utils.Exist(hintPath(b.path, last)) {
+		last++
+	}
 	curr, err := df.NewBkFile(b.path, last, true)
 	if err != nil {
 		return
 	}
 	b.curr = curr
-	b.indexer = idx
-	b.dataFiles = dfs
 	return
 }
 
+// TailRecovery the torn tail discarded from the active datafile on open
+type TailRecovery struct {
+	FileID    int   // datafile whose tail is discarded
+	Offset    int64 // end of the last intact entry, where the datafile is truncated
+	Discarded int64 // count of bytes discarded
+}
+
+// recoverTail 逐条校验活跃文件的记录，第一条不完整或校验失败的记录延伸到文件末尾、或之后找不到完好的记录时，
+// 是宕机时写了一半的尾部，从这里截断，丢弃的字节数报告给回调，没有设置回调时写入日志；
+// 之后还有完好的记录说明是数据损坏，不能截断，返回*ErrCorruptEntry，需要用Repair隔离损坏的区域
+func (b *BitCask) recoverTail(f df.DataFile) error {
+	size := f.Size()
+	good, torn, err := f.Verify()
+	if err != nil || good == size {
+		return err
+	}
+	if !torn {
+		return &ErrCorruptEntry{FileID: f.FileID(), Offset: good, Err: ErrRepairRequired}
+	}
+	if err = f.Truncate(good); err != nil {
+		return err
+	}
+	r := TailRecovery{FileID: f.FileID(), Offset: good, Discarded: size - good}
+	if b.config.OnRecover != nil {
+		b.config.OnRecover(r)
+		return nil
+	}
+	log.Printf("bitcask: truncate torn tail of %s at %d, %d bytes discarded", f.Name(), r.Offset, r.Discarded)
+	return nil
+}
+
+// loadIndexes 按文件id顺序加载索引：存在hint文件时直接读取hint文件，
+// 否则重放数据文件中的记录，保证宕机后已写入的数据不丢失
+func (b *BitCask) loadIndexes() error {
+	// 旧版本的整体索引文件已由hint文件取代，只读模式不做清理
+	if !b.config.ReadOnly {
+		if err := os.RemoveAll(filepath.Join(b.path, IndexFile)); err != nil {
+			return err
+		}
+	}
+	fids := make([]int, 0, len(b.dataFiles))
+	for id := range b.dataFiles {
+		fids = append(fids, id)
+	}
+	sort.Ints(fids)
+	// 记录重放过程中遇到的删除序号，防止序号更小的旧记录使key复活
+	deleted := make(map[string]uint64)
+	for i, fid := range fids {
+		ok, err := b.loadHint(fid, deleted)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		// 读写模式已截断活跃文件不完整的尾部，只读模式不修改文件，最后一个文件末尾写了一半的记录直接忽略
+		err = scanError(fid, b.replay(fid, deleted))
+		var corrupt *ErrCorruptEntry
+		if b.config.ReadOnly && i == len(fids)-1 && errors.As(err, &corrupt) && corrupt.Err == ErrTruncatedEntry {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, fid := range fids {
+		b.metadata.Fill(fid, b.dataFiles[fid].Size())
+	}
+	b.cleanStats()
+	return nil
+}
+
+// loadHint 读取数据文件对应的hint文件，hint文件不存在或损坏时返回false
+func (b *BitCask) loadHint(fid int, deleted map[string]uint64) (bool, error) {
+	fp := hintPath(b.path, fid)
+	if !utils.Exist(fp) {
+		return false, nil
+	}
+	hintf, err := os.Open(fp)
+	if err != nil {
+		return false, err
+	}
+	defer hintf.Close()
+	stat, err := hintf.Stat()
+	if err != nil {
+		return false, err
+	}
+	// 完整读取后才应用，hint文件损坏时改为重放数据文件
+	var keys [][]byte
+	var items []internal.Item
+	err = idx.ReadHints(hintf, stat.Size(), fid, func(key []byte, item internal.Item) error {
+		keys = append(keys, key)
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return false, nil
+	}
+	for i, item := range items {
+		// 合并保留下来的删除记录，hint中不记录大小
+		tombstone := idx.IsTombstone(item)
+		if tombstone {
+			item.ValueSize = internal.EntryHeaderSize + len(keys[i])
+		}
+		b.restore(keys[i], item, tombstone, true, deleted)
+	}
+	return true, nil
+}
+
+// replay 重放数据文件中的记录，恢复索引；
+// 批量写入的记录暂存起来，读到提交标记后才生效，没有提交标记的批量记录被丢弃
+func (b *BitCask) replay(fid int, deleted map[string]uint64) error {
+	var pending []replayEntry
+	return b.dataFiles[fid].Scan(0, func(e *internal.Entry, offset int64, size int) error {
+		if !e.IsValid() {
+			return &ErrCorruptEntry{FileID: fid, Offset: offset, Err: ErrInvalidCheckSum}
+		}
+		if e.Seq() > b.seq {
+			b.seq = e.Seq()
+		}
+		mode := e.Mode()
+		switch {
+		case mode.InBatch():
+			pending = append(pending, replayEntry{entry: e, offset: offset, size: size})
+			return nil
+		case mode == internal.ModeBatchCommit:
+			if len(e.Value()) != 4 {
+				return ErrInvalidBatch
+			}
+			n := int(binary.LittleEndian.Uint32(e.Value()))
+			if n > len(pending) {
+				return ErrInvalidBatch
+			}
+			// 提交标记只对紧挨着它的n条记录生效，之前未提交的批量记录被丢弃
+			for _, p := range pending[len(pending)-n:] {
+				if err := b.apply(fid, p.entry, p.offset, p.size, deleted); err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+			return nil
+		default:
+			pending = pending[:0]
+			return b.apply(fid, e, offset, size, deleted)
+		}
+	})
+}
+
+// scanError 将扫描数据文件时无法解析的记录转换为*ErrCorruptEntry
+func scanError(fid int, err error) error {
+	var e *df.EntryError
+	if errors.As(err, &e) {
+		return &ErrCorruptEntry{FileID: fid, Offset: e.Offset, Err: e.Err}
+	}
+	return err
+}
+
+// replayEntry 重放时暂存的批量记录
+type replayEntry struct {
+	entry  *internal.Entry
+	offset int64
+	size   int
+}
+
+// apply 将重放的记录应用到内存索引
+func (b *BitCask) apply(fid int, e *internal.Entry, offset int64, size int, deleted map[string]uint64) error {
+	op := e.Mode().Op()
+	if op != internal.ModePut && op != internal.ModeDelete {
+		return ErrUnknownMode
+	}
+	item := internal.Item{
+		FileID:    fid,
+		ValueSize: size,
+		ValuePos:  offset,
+		TimeStamp: e.Timestamp(),
+		ExpiredAt: e.ExpiredAt(),
+		Seq:       e.Seq(),
+	}
+	b.restore(e.Key(), item, op == internal.ModeDelete, false, deleted)
+	return nil
+}
+
+// restore 以序号判断记录新旧并更新内存索引与文件统计，序号更小的记录视为已被覆盖；
+// 写入时的删除记录计为无效字节，合并保留下来的删除记录(merged)仍需遮蔽其他文件中的旧记录，计为有效字节
+func (b *BitCask) restore(key []byte, item internal.Item, tombstone, merged bool, deleted map[string]uint64) {
+	size := int64(item.ValueSize)
+	old, ok := b.indexer.Get(key)
+	if (ok && old.Seq > item.Seq) || deleted[string(key)] > item.Seq {
+		b.metadata.Append(item.FileID, size, item.Seq, false)
+		return
+	}
+	if ok {
+		b.metadata.Discard(old.FileID, int64(old.ValueSize))
+	}
+	if tombstone {
+		deleted[string(key)] = item.Seq
+		b.indexer.Delete(key)
+		b.metadata.Append(item.FileID, size, item.Seq, merged)
+		return
+	}
+	// 最新的记录已过期，等同于在此序号删除
+	if item.IsExpired(time.Now().UnixNano()) {
+		deleted[string(key)] = item.Seq
+		b.indexer.Delete(key)
+		b.metadata.Append(item.FileID, size, item.Seq, false)
+		return
+	}
+	b.indexer.Add(key, item)
+	b.metadata.Append(item.FileID, size, item.Seq, true)
+}
+
 // Get Retrieve a value by key from a Bitcask datastore.
 func (b *BitCask) Get(key []byte) ([]byte, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 	// 先从内存索引中获取此记录的信息，通过一次磁盘随机IO获取数据
-	item, ok := b.indexer.Get(key)
+	item, ok := b.lookup(key)
 	if !ok {
 		return nil, ErrSpecifyKeyNotExist
 	}
+	return b.read(item)
+}
+
+// lookup 查询内存索引，已过期的key视为不存在
+func (b *BitCask) lookup(key []byte) (internal.Item, bool) {
+	item, ok := b.indexer.Get(key)
+	if !ok || item.IsExpired(time.Now().UnixNano()) {
+		return internal.Item{}, false
+	}
+	return item, true
+}
+
+// read 根据索引读取数据文件中的value
+func (b *BitCask) read(item internal.Item) ([]byte, error) {
 	bk := b.curr
 	// 读到的item所在文件可能是active和older
 	if !b.isInActiveFile(item.FileID) {
 		bk = b.dataFiles[item.FileID]
 	}
-	e, err := bk.Read(item.ValuePos, item.ValueSize)
+	return readValue(bk, item)
+}
+
+// readValue 读取索引指向的记录，记录损坏时报告所在的文件与偏移
+func readValue(f df.DataFile, item internal.Item) ([]byte, error) {
+	e, err := f.Read(item.ValuePos, item.ValueSize)
+	if err == ErrTruncatedEntry || err == ErrCorruptHeader {
+		return nil, &ErrCorruptEntry{FileID: item.FileID, Offset: item.ValuePos, Err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
 	if !e.IsValid() {
-		return nil, ErrInvalidCheckSum
+		return nil, &ErrCorruptEntry{FileID: item.FileID, Offset: item.ValuePos, Err: ErrInvalidCheckSum}
 	}
 	return e.Value(), nil
 }
@@ -115,7 +445,7 @@ func (b *BitCask) Get(key []byte) ([]byte, error) {
 func (b *BitCask) Has(key []byte) bool {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
-	_, ok := b.indexer.Get(key)
+	_, ok := b.lookup(key)
 	return ok
 }
 
@@ -125,25 +455,108 @@ func (b *BitCask) Put(key, value []byte) error {
 	if err != nil {
 		return err
 	}
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	pos, size, err := b.put(key, value)
+	return b.submit(internal.ModePut, key, value, 0)
+}
+
+// PutWithTTL Store a key and value which expires after ttl.
+func (b *BitCask) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	err := b.validKV(key, value)
 	if err != nil {
 		return err
 	}
-	b.reclaimDetect(key)
-	// 再加到索引
-	b.indexer.Add(key, index.NewItem(b.curr.FileID(), pos, size))
+	return b.submit(internal.ModePut, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire Set a timeout on an existing key, the key is rewritten with the new expiry.
+func (b *BitCask) Expire(key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return b.write(func() error {
+		item, ok := b.lookup(key)
+		if !ok {
+			return ErrSpecifyKeyNotExist
+		}
+		value, err := b.read(item)
+		if err != nil {
+			return err
+		}
+		return b.set(key, value, time.Now().Add(ttl).UnixNano())
+	})
+}
+
+// TTL Returns the remaining time to live of a key, -1 if the key never expires.
+func (b *BitCask) TTL(key []byte) (time.Duration, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	item, ok := b.lookup(key)
+	if !ok {
+		return 0, ErrSpecifyKeyNotExist
+	}
+	if item.ExpiredAt == 0 {
+		return -1, nil
+	}
+	return time.Duration(item.ExpiredAt - time.Now().UnixNano()), nil
+}
+
+// set 写入记录并按同步模式落盘后更新内存索引，expiredAt为0表示永不过期，调用方需持有写锁
+func (b *BitCask) set(key, value []byte, expiredAt int64) error {
+	e := b.newEntry(key, value, internal.ModePut, b.nextSeq(), expiredAt)
+	pos, size, err := b.put(e)
+	if err != nil {
+		return err
+	}
+	if err = b.syncActive(); err != nil {
+		return err
+	}
+	b.addIndex(e, pos, size)
+	return nil
+}
+
+// newEntry 按配置的校验算法生成记录
+func (b *BitCask) newEntry(key, value []byte, mode internal.Mode, seq uint64, expiredAt int64) *internal.Entry {
+	return internal.NewEntryWithExpire(key, value, mode, seq, expiredAt).WithChecksum(b.config.Checksum)
+}
+
+// setEntry 写入已分配序号的记录后更新内存索引，合并时沿用原记录的序号，调用方需持有写锁
+func (b *BitCask) setEntry(e *internal.Entry) error {
+	pos, size, err := b.put(e)
+	if err != nil {
+		return err
+	}
+	b.addIndex(e, pos, size)
 	return nil
 }
 
+// addIndex 记录写入活跃文件后计入文件统计并更新内存索引，调用方需持有写锁
+func (b *BitCask) addIndex(e *internal.Entry, pos int64, size int) {
+	b.metadata.Append(b.curr.FileID(), int64(size), e.Seq(), true)
+	b.reclaimDetect(e.Key())
+	// 再加到索引
+	item := index.NewItem(b.curr.FileID(), pos, size)
+	item.ExpiredAt = e.ExpiredAt()
+	item.Seq = e.Seq()
+	b.indexer.Add(e.Key(), item)
+	if e.Seq() > b.seq {
+		b.seq = e.Seq()
+	}
+}
+
+// nextSeq 分配下一个写入序号，调用方需持有写锁
+func (b *BitCask) nextSeq() uint64 {
+	b.seq++
+	return b.seq
+}
+
+// reclaimDetect key原有的记录变为无效，计入所在文件的无效字节，调用方需持有写锁
 func (b *BitCask) reclaimDetect(key []byte) {
 	if item, ok := b.indexer.Get(key); ok {
-		b.metadata.ReclaimSpace += int64(item.ValueSize + len(key))
-	}
-	if b.metadata.ReclaimSpace > b.config.MaxReclaimSpace {
-		go func() { b.needMerge <- struct{}{} }()
+		b.metadata.Discard(item.FileID, int64(item.ValueSize))
 	}
+	b.needMergeDetect()
 }
 
 func (b *BitCask) validKV(key, value []byte) error {
@@ -159,124 +572,179 @@ func (b *BitCask) validKV(key, value []byte) error {
 	return nil
 }
 
-func (b *BitCask) put(key, value []byte) (offset int64, size int, err error) {
-	// 判断当前文件是否超出大小限制，需要关闭旧文件，创建新文件
-	if b.isActiveFileExceedLimit() {
-		err := b.curr.Close()
-		if err != nil {
-			return 0, 0, err
-		}
-		id := b.curr.FileID()
-		oldDf, err := df.NewBkFile(b.path, id, false)
-		if err != nil {
-			return 0, 0, err
-		}
-		b.dataFiles[id] = oldDf
-		newDf, err := df.NewBkFile(b.path, id+1, true)
-		if err != nil {
-			return 0, 0, err
-		}
-		b.curr = newDf
+func (b *BitCask) put(entry *internal.Entry) (offset int64, size int, err error) {
+	if b.config.ReadOnly {
+		err = ErrReadOnly
+		return
+	}
+	if err = b.rotate(); err != nil {
+		return
 	}
-	offset, size, err = b.curr.Write(internal.NewEntry(key, value))
+	offset, size, err = b.curr.Write(entry)
 	return
 }
 
-// Delete a key from a Bitcask datastore.
-func (b *BitCask) Delete(key []byte) error {
-	// 创建记录
-	entry := internal.NewEntry(key, nil)
-	// 写入磁盘
-	_, _, err := b.curr.Write(entry)
+// rotate 判断当前文件是否超出大小限制，需要关闭旧文件，创建新文件
+func (b *BitCask) rotate() error {
+	if !b.isActiveFileExceedLimit() {
+		return nil
+	}
+	err := b.curr.Close()
 	if err != nil {
 		return err
 	}
-	b.reclaimDetect(key)
-	// 内存索引中标记
-	b.indexer.Delete(key)
+	id := b.curr.FileID()
+	oldDf, err := df.NewBkFile(b.path, id, false)
+	if err != nil {
+		return err
+	}
+	b.dataFiles[id] = oldDf
+	newDf, err := df.NewBkFile(b.path, id+1, true)
+	if err != nil {
+		return err
+	}
+	b.curr = newDf
 	return nil
 }
 
-// ListKeys List all keys in a Bitcask datastore.
+// Delete a key from a Bitcask datastore.
+func (b *BitCask) Delete(key []byte) error {
+	return b.submit(internal.ModeDelete, key, nil, 0)
+}
+
+// ListKeys List all keys in a Bitcask datastore in key order.
 func (b *BitCask) ListKeys() []string {
-	return b.indexer.Keys()
+	keys := make([]string, 0)
+	it := b.NewIterator(IteratorOptions{KeyOnly: true})
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
 }
 
-// Fold over all K/V pairs in a Bitcask datastore.
+// Fold over all K/V pairs in a Bitcask datastore in key order.
 // Fun is expected to be of the form: F(K,V,Acc0) → Acc.
+// f may call other methods of the database, the lock is not held while it runs.
 func (b *BitCask) Fold(f func(key []byte) error) (err error) {
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-	for key := range b.indexer.Index() {
-		kb := utils.Str2Bytes(key)
-		if err := f(kb); err != nil {
+	it := b.NewIterator(IteratorOptions{KeyOnly: true})
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if err := f(it.Key()); err != nil {
 			return err
 		}
 	}
 	return
 }
 
-// merge Merge several data files within a Bitcask datastore into a more compact form.
-// Also, produce hintfiles for faster startup.
-func (b *BitCask) merge() error {
-	if b.isMerging {
-		return ErrMergeInProgress
-	}
-	b.isMerging = true
-	defer func() {
-		b.isMerging = false
-	}()
-	// 将当前活跃文件关闭
-	err := b.closeActiveFile()
-	if err != nil {
-		return err
-	}
-	// 整理所有待合并的文件列表
-	mergeFiles := make([]int, 0, len(b.dataFiles))
-	for i := range b.dataFiles {
-		mergeFiles = append(mergeFiles, i)
-	}
-	sort.Ints(mergeFiles)
-	// 获取合并的文件中最后一个文件
-	lastMergeFile := mergeFiles[len(mergeFiles)-1]
-	// 创建一个新的file用于写操作
-	err = b.newActiveFile()
-	if err != nil {
-		return err
+// Stats summary of a database
+type Stats struct {
+	Keys        int    // live keys, expired keys are excluded
+	DataFiles   int    // datafiles including the active one
+	Size        int64  // bytes of datafiles
+	DeadBytes   int64  // bytes of overwritten, deleted or expired records
+	Reclaimable int64  // dead bytes of datafiles reaching MergePolicy.MinGarbageRatio
+	Seq         uint64 // last sequence number written
+}
+
+// Stats returns summary of the database
+func (b *BitCask) Stats() Stats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	s := Stats{
+		DataFiles:   len(b.dataFiles) + 1,
+		Size:        b.curr.Size(),
+		DeadBytes:   b.metadata.ReclaimSpace,
+		Reclaimable: b.metadata.Reclaimable(b.config.MergePolicy.MinGarbageRatio),
+		Seq:         b.seq,
+	}
+	for _, f := range b.dataFiles {
+		s.Size += f.Size()
+	}
+	now := time.Now().UnixNano()
+	for _, item := range b.indexer.Index() {
+		if !item.IsExpired(now) {
+			s.Keys++
+		}
 	}
-	mergeDB, err := b.newTmpMergeDB(lastMergeFile)
-	if err != nil {
-		return err
+	return s
+}
+
+// sweep 后台定期清理内存索引中已过期的key，即使没有读取也能释放内存
+func (b *BitCask) sweep() {
+	ticker := time.NewTicker(b.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.evictExpired()
+		}
 	}
-	defer os.RemoveAll(mergeDB.path)
-	// todo 关闭当前 bitcask，不可写不可读
-	if err = b.Close(); err != nil {
-		return err
+}
+
+// evictExpired 将已过期的key从内存索引中删除，并计入待回收空间
+func (b *BitCask) evictExpired() {
+	now := time.Now().UnixNano()
+	var expired []string
+	b.lock.RLock()
+	for key, item := range b.indexer.Index() {
+		if item.IsExpired(now) {
+			expired = append(expired, key)
+		}
 	}
-	// 将旧的文件删除,将合并后的文件，改到当前db文件夹下
-	if err = b.removeOldFiles(lastMergeFile, mergeDB); err != nil {
-		return err
+	b.lock.RUnlock()
+	if len(expired) == 0 {
+		return
 	}
-	b.metadata.ReclaimSpace = 0
-	if err = b.rebuild(); err != nil {
-		return err
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, key := range expired {
+		kb := utils.Str2Bytes(key)
+		// 加锁后再次确认，期间可能被重新写入
+		if item, ok := b.indexer.Get(kb); ok && item.IsExpired(now) {
+			b.reclaimDetect(kb)
+			b.indexer.Delete(kb)
+		}
 	}
-	return nil
 }
 
 // Sync Force any writes to sync to disk.
 func (b *BitCask) Sync() error {
-	return b.curr.Sync()
+	b.lock.RLock()
+	f := b.curr
+	b.lock.RUnlock()
+	return f.Sync()
 }
 
-// Close a Bitcask data store and flush all pending writes (if any) to disk.
+// Close a Bitcask data store and flush all pending writes (if any) to disk. It waits for an
+// in-flight Merge to finish, closing a closed database returns ErrDatabaseClosed.
 func (b *BitCask) Close() error {
-	// 保存内存索引文件
-	// 保存元数据、配置
-	// 将归档文件落盘
-	if err := b.indexer.Sync(b.path); err != nil {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return ErrDatabaseClosed
+	}
+	close(b.done)
+	// 后台合并随关闭取消，等待进行中的合并结束后再关闭文件
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.config.ReadOnly {
+		if err := b.saveMeta(true); err != nil {
+			return err
+		}
+	}
+	if err := b.closeFiles(); err != nil {
 		return err
 	}
+	return b.unlockDir()
+}
+
+// closeFiles 关闭所有数据文件
+func (b *BitCask) closeFiles() error {
+	// 保存元数据、配置
+	// 将归档文件落盘
 	for _, file := range b.dataFiles {
 		if err := file.Close(); err != nil {
 			return err
@@ -323,21 +791,9 @@ func loadDataFiles(path string) (map[int]df.DataFile, int, error) {
 	return datafiles, last, nil
 }
 
-func loadIndexes(path string) (idx.Index, error) {
-	newIndex := index.NewKeyDir()
-	path = filepath.Join(path, IndexFile)
-	if !utils.Exist(path) {
-		return newIndex, nil
-	}
-	hintf, err := os.Open(path)
-	if err != nil {
-		return newIndex, err
-	}
-	err = newIndex.Load(hintf)
-	if err != nil {
-		return newIndex, err
-	}
-	return newIndex, nil
+// hintPath 数据文件对应的hint文件路径
+func hintPath(path string, fid int) string {
+	return filepath.Join(path, fmt.Sprintf(idx.DefaultHintFileName, fid))
 }
 
 // closeActiveFile 将当前活跃的文件关闭并加入旧文件列表
@@ -363,70 +819,3 @@ func (b *BitCask) newActiveFile() error {
 	b.curr = activef
 	return nil
 }
-
-// removeOldFiles 删除已经被merge的旧数据文件
-func (b *BitCask) removeOldFiles(lastMergeFileID int, mergeDB *BitCask) error {
-	// path内存放 旧数据文件+活跃文件+索引文件+临时db目录/合并后的文件+索引文件
-	fs, err := ioutil.ReadDir(b.path)
-	if err != nil {
-		return err
-	}
-	for _, f := range fs {
-		// 如果是目录文件，跳过
-		if f.IsDir() {
-			continue
-		}
-		fid, err := utils.GetDataFileIDs([]string{f.Name()})
-		if err != nil {
-			return err
-		}
-		// fid 就是[1]这样只存一个int的数组
-		// 如果是活跃文件，跳过
-		if len(fid) > 0 && fid[0] > lastMergeFileID {
-			continue
-		}
-		if err = os.Remove(filepath.Join(b.path, f.Name())); err != nil {
-			return err
-		}
-	}
-	mergedf, err := ioutil.ReadDir(mergeDB.path)
-	if err != nil {
-		return err
-	}
-	for _, file := range mergedf {
-		if err = os.Rename(filepath.Join(mergeDB.path, file.Name()), filepath.Join(b.path, file.Name())); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (b *BitCask) newTmpMergeDB(lastMergeFile int) (*BitCask, error) {
-	// 创建一个临时目录，用于存放合并的db
-	temp, err := ioutil.TempDir(b.path, MergeTmpFolder)
-	if err != nil {
-		return nil, err
-	}
-	mergeDB, err := Open(temp, WithConfig(b.config))
-	if err != nil {
-		return nil, err
-	}
-	defer mergeDB.Close()
-	err = b.Fold(func(key []byte) error {
-		// 如果是正在写入到新文件的数据，不参与合并
-		item, _ := b.indexer.Get(key)
-		if item.FileID > lastMergeFile {
-			return nil
-		}
-		val, err := b.Get(key)
-		if err != nil {
-			return err
-		}
-		err = mergeDB.Put(key, val)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-	return mergeDB, nil
-}
@@ -1,14 +1,35 @@
 package bitcask
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/utils"
 )
 
+// crash 模拟宕机：停止后台协程并释放目录锁，不执行 Close 的落盘逻辑
+func crash(db *BitCask) {
+	close(db.done)
+	db.flock.Release()
+}
+
 func TestAll(t *testing.T) {
 	var (
 		db *BitCask
@@ -16,8 +37,8 @@ func TestAll(t *testing.T) {
 
 	testDir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
 
-	testDir = "data"
 	t.Run("open", func(t *testing.T) {
 		db, err = Open(testDir, WithMaxFileSize(1024))
 		assert.NoError(t, err)
@@ -57,10 +78,39 @@ func TestAll(t *testing.T) {
 	t.Run("list-test", func(t *testing.T) {
 		list := db.ListKeys()
 		fmt.Println(list)
+		assert.True(t, sort.StringsAreSorted(list))
+	})
+
+	t.Run("fold", func(t *testing.T) {
+		// 回调中读取的同时有写入在等待写锁，不能死锁
+		var wg sync.WaitGroup
+		done := make(chan error, 1)
+		go func() {
+			var once sync.Once
+			done <- db.Fold(func(key []byte) error {
+				once.Do(func() {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						assert.NoError(t, db.Put([]byte("fold"), []byte("value")))
+					}()
+					time.Sleep(time.Millisecond)
+				})
+				_, err := db.Get(key)
+				return err
+			})
+		}()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("fold deadlocked")
+		}
+		wg.Wait()
 	})
 
 	t.Run("merge", func(t *testing.T) {
-		err = db.merge()
+		err = db.Merge(context.Background())
 		assert.NoError(t, err)
 		assert.Equal(t, int64(0), db.metadata.ReclaimSpace)
 	})
@@ -70,3 +120,1879 @@ func TestAll(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestRebuild(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1024))
+	assert.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, db.Delete([]byte("key3")))
+	assert.NoError(t, db.Put([]byte("empty"), nil))
+	// 不调用 Close 模拟宕机
+	crash(db)
+
+	t.Run("without hint", func(t *testing.T) {
+		// 通过重放数据文件恢复索引
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		for i := 0; i < 40; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			if i == 3 {
+				assert.Equal(t, ErrSpecifyKeyNotExist, err)
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+		}
+		// 空值不会被当作删除
+		val, err := db.Get([]byte("empty"))
+		assert.NoError(t, err)
+		assert.Empty(t, val)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("key0"), []byte("new value")))
+		assert.NoError(t, db.Put([]byte("key40"), []byte("value:40")))
+		crash(db)
+
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		val, err := db.Get([]byte("key0"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new value"), val)
+		val, err = db.Get([]byte("key40"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value:40"), val)
+		assert.False(t, db.Has([]byte("key3")))
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("with hint", func(t *testing.T) {
+		// 只有少量无效记录，降低合并比例使其参与合并
+		db, err := Open(testDir, WithMergeRatio(0.01))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Merge(context.Background()))
+		hints, err := filepath.Glob(filepath.Join(testDir, "*.hint"))
+		assert.NoError(t, err)
+		assert.NotEmpty(t, hints)
+		assert.NoError(t, db.Put([]byte("key41"), []byte("value:41")))
+		assert.NoError(t, db.Close())
+
+		// 损坏的hint文件会回退到重放数据文件，key大小超出文件的项不会按声明的大小分配
+		huge := make([]byte, 40)
+		binary.LittleEndian.PutUint32(huge[8:12], math.MaxUint32)
+		for _, broken := range [][]byte{[]byte("broken"), huge} {
+			assert.NoError(t, ioutil.WriteFile(hints[0], broken, 0600))
+			db, err = Open(testDir)
+			assert.NoError(t, err)
+			for i := 0; i < 42; i++ {
+				assert.Equal(t, i != 3, db.Has([]byte(fmt.Sprintf("key%v", i))))
+			}
+			val, err := db.Get([]byte("key0"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("new value"), val)
+			assert.NoError(t, db.Close())
+		}
+	})
+}
+
+func TestTTL(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithSweepInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	t.Run("put with ttl", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidTTL, db.PutWithTTL([]byte("key"), []byte("value"), 0))
+		assert.NoError(t, db.PutWithTTL([]byte("key"), []byte("value"), 50*time.Millisecond))
+		val, err := db.Get([]byte("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), val)
+		ttl, err := db.TTL([]byte("key"))
+		assert.NoError(t, err)
+		assert.True(t, ttl > 0 && ttl <= 50*time.Millisecond)
+
+		time.Sleep(60 * time.Millisecond)
+		_, err = db.Get([]byte("key"))
+		assert.Equal(t, ErrSpecifyKeyNotExist, err)
+		assert.False(t, db.Has([]byte("key")))
+		assert.NotContains(t, db.ListKeys(), "key")
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		assert.NoError(t, db.Put([]byte("persist"), []byte("value")))
+		ttl, err := db.TTL([]byte("persist"))
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(-1), ttl)
+
+		assert.NoError(t, db.Expire([]byte("persist"), time.Hour))
+		ttl, err = db.TTL([]byte("persist"))
+		assert.NoError(t, err)
+		assert.True(t, ttl > time.Minute)
+		val, err := db.Get([]byte("persist"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), val)
+		assert.Equal(t, ErrSpecifyKeyNotExist, db.Expire([]byte("missing"), time.Hour))
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		assert.NoError(t, db.PutWithTTL([]byte("swept"), []byte("value"), time.Millisecond))
+		time.Sleep(50 * time.Millisecond)
+		// 后台清理后内存索引中不再保留过期key
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		assert.False(t, db.indexer.Has([]byte("swept")))
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		assert.NoError(t, db.PutWithTTL([]byte("short"), []byte("value"), 20*time.Millisecond))
+		assert.NoError(t, db.Close())
+		time.Sleep(30 * time.Millisecond)
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		assert.False(t, db.Has([]byte("short")))
+		assert.True(t, db.Has([]byte("persist")))
+		ttl, err := db.TTL([]byte("persist"))
+		assert.NoError(t, err)
+		assert.True(t, ttl > time.Minute)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		assert.NoError(t, db.PutWithTTL([]byte("merged"), []byte("value"), 20*time.Millisecond))
+		time.Sleep(30 * time.Millisecond)
+		assert.NoError(t, db.Merge(context.Background()))
+		assert.NoError(t, db.Close())
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		assert.False(t, db.indexer.Has([]byte("merged")))
+		assert.True(t, db.Has([]byte("persist")))
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestWriteBatch(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir)
+	assert.NoError(t, err)
+	// 测试直接写入活跃文件，避免后台合并切换活跃文件
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	assert.NoError(t, db.Put([]byte("user:1:name"), []byte("old")))
+
+	t.Run("write batch", func(t *testing.T) {
+		b := NewBatch()
+		b.Put([]byte("user:1"), []byte("zach"))
+		b.Put([]byte("name:zach"), []byte("user:1"))
+		b.Delete([]byte("user:1:name"))
+		assert.Equal(t, 3, b.Len())
+		assert.NoError(t, db.WriteBatch(b))
+
+		val, err := db.Get([]byte("name:zach"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("user:1"), val)
+		assert.False(t, db.Has([]byte("user:1:name")))
+
+		b.Reset()
+		b.Put(nil, []byte("value"))
+		assert.Equal(t, ErrEmptyKey, db.WriteBatch(b))
+	})
+
+	t.Run("uncommitted batch", func(t *testing.T) {
+		// 模拟批量写入过程中宕机：只写入了部分记录，没有提交标记
+		_, _, err := db.curr.Write(internal.NewEntry([]byte("user:2"), []byte("lost"), internal.ModePut|internal.ModeBatch, db.nextSeq()))
+		assert.NoError(t, err)
+		_, _, err = db.curr.Write(internal.NewEntry([]byte("user:1"), nil, internal.ModeDelete|internal.ModeBatch, db.nextSeq()))
+		assert.NoError(t, err)
+		b := NewBatch()
+		b.Put([]byte("user:3"), []byte("kept"))
+		assert.NoError(t, db.WriteBatch(b))
+		crash(db)
+
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		assert.False(t, db.Has([]byte("user:2")))
+		assert.True(t, db.Has([]byte("user:1")))
+		val, err := db.Get([]byte("user:3"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("kept"), val)
+		val, err = db.Get([]byte("name:zach"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("user:1"), val)
+		assert.False(t, db.Has([]byte("user:1:name")))
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("invalid commit", func(t *testing.T) {
+		// 提交标记的value不是4字节的记录数
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		_, _, err = db.curr.Write(internal.NewEntry([]byte("user:4"), []byte("value"), internal.ModePut|internal.ModeBatch, db.nextSeq()))
+		assert.NoError(t, err)
+		_, _, err = db.curr.Write(internal.NewEntry(nil, []byte{1}, internal.ModeBatchCommit, db.nextSeq()))
+		assert.NoError(t, err)
+		crash(db)
+		_, err = Open(testDir)
+		assert.Equal(t, ErrInvalidBatch, err)
+	})
+}
+
+func TestSeq(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1024))
+	assert.NoError(t, err)
+	// 避免后台合并与手动合并并发执行
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Put([]byte("key"), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	item, _ := db.indexer.Get([]byte("key"))
+	assert.Equal(t, uint64(40), item.Seq)
+	assert.NoError(t, db.Close())
+
+	t.Run("replay", func(t *testing.T) {
+		// 同一秒内多次写入同一个key，由序号决定最新的记录
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		val, err := db.Get([]byte("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value:39"), val)
+		assert.Equal(t, uint64(40), db.seq)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("stale record", func(t *testing.T) {
+		// 序号更小的记录即使写在后面也不会覆盖新记录
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		_, _, err = db.curr.Write(internal.NewEntry([]byte("key"), []byte("stale"), internal.ModePut, 1))
+		assert.NoError(t, err)
+		_, _, err = db.curr.Write(internal.NewEntry([]byte("gone"), nil, internal.ModeDelete, 50))
+		assert.NoError(t, err)
+		_, _, err = db.curr.Write(internal.NewEntry([]byte("gone"), []byte("stale"), internal.ModePut, 2))
+		assert.NoError(t, err)
+		crash(db)
+
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		val, err := db.Get([]byte("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value:39"), val)
+		assert.False(t, db.Has([]byte("gone")))
+		assert.Equal(t, uint64(50), db.seq)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+		assert.NoError(t, db.Delete([]byte("key")))
+		assert.NoError(t, db.Merge(context.Background()))
+		// 删除记录被合并丢弃后，最大序号依然保留
+		assert.NoError(t, db.Close())
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(51), db.seq)
+		assert.NoError(t, db.Put([]byte("key"), []byte("new")))
+		item, _ := db.indexer.Get([]byte("key"))
+		assert.Equal(t, uint64(52), item.Seq)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestTxn(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Put([]byte("counter"), []byte("1")))
+
+	t.Run("update", func(t *testing.T) {
+		err := db.Update(func(tx *Txn) error {
+			val, err := tx.Get([]byte("counter"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("1"), val)
+			assert.NoError(t, tx.Put([]byte("counter"), []byte("2")))
+			assert.NoError(t, tx.Delete([]byte("missing")))
+			// 事务内可以读到自己未提交的写入
+			val, err = tx.Get([]byte("counter"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("2"), val)
+			_, err = tx.Get([]byte("missing"))
+			assert.Equal(t, ErrSpecifyKeyNotExist, err)
+			return nil
+		})
+		assert.NoError(t, err)
+		val, err := db.Get([]byte("counter"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("2"), val)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		err := db.Update(func(tx *Txn) error {
+			_, err := tx.Get([]byte("counter"))
+			assert.NoError(t, err)
+			_, err = tx.Get([]byte("new"))
+			assert.Equal(t, ErrSpecifyKeyNotExist, err)
+			assert.NoError(t, tx.Put([]byte("counter"), []byte("3")))
+			// 其他写入者修改了事务读过的key
+			return db.Put([]byte("counter"), []byte("other"))
+		})
+		assert.Equal(t, ErrConflict, err)
+		val, err := db.Get([]byte("counter"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("other"), val)
+
+		err = db.Update(func(tx *Txn) error {
+			_, err := tx.Get([]byte("new"))
+			assert.Equal(t, ErrSpecifyKeyNotExist, err)
+			assert.NoError(t, tx.Put([]byte("new"), []byte("mine")))
+			return db.Put([]byte("new"), []byte("other"))
+		})
+		assert.Equal(t, ErrConflict, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		err := db.Update(func(tx *Txn) error {
+			assert.NoError(t, tx.Put([]byte("counter"), []byte("4")))
+			return ErrEmptyKey
+		})
+		assert.Equal(t, ErrEmptyKey, err)
+		val, err := db.Get([]byte("counter"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("other"), val)
+	})
+
+	t.Run("view", func(t *testing.T) {
+		err := db.View(func(tx *Txn) error {
+			val, err := tx.Get([]byte("counter"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("other"), val)
+			return tx.Put([]byte("counter"), []byte("5"))
+		})
+		assert.Equal(t, ErrTxnReadOnly, err)
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1024))
+	assert.NoError(t, err)
+	defer db.Close()
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	snap, err := db.Snapshot()
+	assert.NoError(t, err)
+
+	// 快照创建后的写入、删除、文件切换对快照不可见
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("changed")))
+	}
+	assert.NoError(t, db.Delete([]byte("key00")))
+	assert.NoError(t, db.Put([]byte("new"), []byte("value")))
+
+	t.Run("get", func(t *testing.T) {
+		val, err := snap.Get([]byte("key00"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value:0"), val)
+		assert.False(t, snap.Has([]byte("new")))
+		_, err = snap.Get([]byte("new"))
+		assert.Equal(t, ErrSpecifyKeyNotExist, err)
+	})
+
+	t.Run("fold", func(t *testing.T) {
+		var keys []string
+		assert.NoError(t, snap.Fold(func(key []byte) error {
+			val, err := snap.Get(key)
+			assert.NoError(t, err)
+			assert.NotEqual(t, []byte("changed"), val)
+			keys = append(keys, string(key))
+			return nil
+		}))
+		assert.Len(t, keys, 20)
+		assert.Equal(t, "key00", keys[0])
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		// 被快照引用的文件不参与合并，快照之后写满的文件照常合并
+		for i := 1; i < 20; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("changed")))
+		}
+		fp := func(fid int) string {
+			return filepath.Join(testDir, fmt.Sprintf("%v%v", fid, DataFileExt))
+		}
+		sizes := make(map[int]int64)
+		for fid := range snap.files {
+			stat, err := os.Stat(fp(fid))
+			assert.NoError(t, err)
+			sizes[fid] = stat.Size()
+		}
+		var reports []MergeProgress
+		db.config.MergeProgress = func(p MergeProgress) {
+			reports = append(reports, p)
+		}
+		assert.NoError(t, db.Merge(context.Background()))
+		last := reports[len(reports)-1]
+		assert.True(t, last.FilesTotal > 0)
+		assert.True(t, last.BytesReclaimed > 0)
+		for fid, size := range sizes {
+			stat, err := os.Stat(fp(fid))
+			assert.NoError(t, err)
+			assert.Equal(t, size, stat.Size())
+		}
+		val, err := snap.Get([]byte("key19"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value:19"), val)
+		val, err = db.Get([]byte("key19"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("changed"), val)
+
+		assert.NoError(t, snap.Close())
+		_, err = snap.Get([]byte("key19"))
+		assert.Equal(t, ErrSnapshotClosed, err)
+		assert.NoError(t, db.Merge(context.Background()))
+		val, err = db.Get([]byte("key19"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("changed"), val)
+		assert.False(t, db.Has([]byte("key00")))
+	})
+}
+
+func TestScan(t *testing.T) {
+	for name, typ := range map[string]IndexType{"hash": HashIndex, "ordered": OrderedIndex} {
+		t.Run(name, func(t *testing.T) {
+			testDir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(t, err)
+			defer os.RemoveAll(testDir)
+
+			db, err := Open(testDir, WithIndexType(typ))
+			assert.NoError(t, err)
+			for _, key := range []string{"user:2:name", "user:1:profile", "user:1:name", "order:1", "user:3", "v"} {
+				assert.NoError(t, db.Put([]byte(key), []byte("value")))
+			}
+			assert.NoError(t, db.PutWithTTL([]byte("user:1:session"), []byte("value"), time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+			assert.NoError(t, db.Close())
+			// 重新打开后索引按配置的类型重建
+			db, err = Open(testDir, WithIndexType(typ))
+			assert.NoError(t, err)
+			defer db.Close()
+
+			collect := func(iter func(f func(key []byte) error) error) []string {
+				var keys []string
+				assert.NoError(t, iter(func(key []byte) error {
+					keys = append(keys, string(key))
+					return nil
+				}))
+				return keys
+			}
+			keys := collect(func(f func(key []byte) error) error { return db.Scan([]byte("user:1:"), f) })
+			assert.Equal(t, []string{"user:1:name", "user:1:profile"}, keys)
+			keys = collect(func(f func(key []byte) error) error { return db.Range([]byte("order:1"), []byte("user:2"), f) })
+			assert.Equal(t, []string{"order:1", "user:1:name", "user:1:profile"}, keys)
+			keys = collect(func(f func(key []byte) error) error { return db.Range([]byte("user:2"), nil, f) })
+			assert.Equal(t, []string{"user:2:name", "user:3", "v"}, keys)
+
+			keys = keys[:0]
+			it := db.NewIterator(IteratorOptions{Reverse: true, Prefix: []byte("user:")})
+			for ; it.Valid(); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			it.Close()
+			assert.Equal(t, []string{"user:3", "user:2:name", "user:1:profile", "user:1:name"}, keys)
+		})
+	}
+}
+
+func TestIterator(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1024), WithIndexType(OrderedIndex))
+	assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+
+	t.Run("value", func(t *testing.T) {
+		for _, prefetch := range []int{0, 8} {
+			it := db.NewIterator(IteratorOptions{Prefix: []byte("key1"), PrefetchSize: prefetch})
+			var n int
+			for it.Seek([]byte("key15")); it.Valid(); it.Next() {
+				i := 15 + n
+				assert.Equal(t, []byte(fmt.Sprintf("key%02d", i)), it.Key())
+				val, err := it.Value()
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+				n++
+			}
+			it.Close()
+			assert.Equal(t, 5, n)
+		}
+	})
+
+	t.Run("lazy value", func(t *testing.T) {
+		it := db.NewIterator(IteratorOptions{})
+		defer it.Close()
+		assert.Equal(t, []byte("key00"), it.Key())
+		// value在读取时才从数据文件获取
+		assert.NoError(t, db.Put([]byte("key00"), []byte("changed")))
+		val, err := it.Value()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("changed"), val)
+		assert.NoError(t, db.Delete([]byte("key01")))
+		it.Next()
+		_, err = it.Value()
+		assert.Equal(t, ErrSpecifyKeyNotExist, err)
+	})
+
+	t.Run("key only", func(t *testing.T) {
+		it := db.NewIterator(IteratorOptions{KeyOnly: true, Reverse: true, PrefetchSize: 8})
+		defer it.Close()
+		assert.Equal(t, []byte("key49"), it.Key())
+		_, err := it.Value()
+		assert.Equal(t, ErrKeyOnlyIterator, err)
+	})
+
+	t.Run("seek with prefix", func(t *testing.T) {
+		seek := func(reverse bool, key string) []string {
+			it := db.NewIterator(IteratorOptions{Prefix: []byte("key1"), Reverse: reverse, KeyOnly: true})
+			defer it.Close()
+			var keys []string
+			for it.Seek([]byte(key)); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			return keys
+		}
+		// 定位目标在前缀范围之外时限制到前缀范围内
+		assert.Len(t, seek(false, "a"), 10)
+		assert.Equal(t, "key10", seek(false, "key")[0])
+		assert.Empty(t, seek(false, "key2"))
+		assert.Equal(t, []string{"key13", "key14", "key15", "key16", "key17", "key18", "key19"}, seek(false, "key13"))
+		assert.Len(t, seek(true, "z"), 10)
+		assert.Equal(t, "key19", seek(true, "key2")[0])
+		assert.Empty(t, seek(true, "key0"))
+		assert.Equal(t, []string{"key12", "key11", "key10"}, seek(true, "key12"))
+	})
+}
+
+func TestLock(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	t.Run("locked", func(t *testing.T) {
+		_, err := Open(testDir)
+		assert.Equal(t, &ErrDatabaseLocked{Path: testDir, PID: os.Getpid()}, err)
+		_, err = Open(testDir, WithReadOnly())
+		assert.IsType(t, &ErrDatabaseLocked{}, err)
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		assert.NoError(t, db.Close())
+		r1, err := Open(testDir, WithReadOnly())
+		assert.NoError(t, err)
+		r2, err := Open(testDir, WithReadOnly())
+		assert.NoError(t, err)
+		val, err := r2.Get([]byte("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), val)
+		assert.Equal(t, ErrReadOnly, r1.Put([]byte("key"), []byte("other")))
+		assert.Equal(t, ErrReadOnly, r1.Delete([]byte("key")))
+
+		// 只读进程持有共享锁时不能以读写模式打开
+		_, err = Open(testDir)
+		assert.Equal(t, &ErrDatabaseLocked{Path: testDir}, err)
+		assert.NoError(t, r1.Close())
+		assert.NoError(t, r2.Close())
+	})
+
+	t.Run("release", func(t *testing.T) {
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Merge(context.Background()))
+		assert.NoError(t, db.Close())
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestClose(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1024), WithMergeRatio(0.1))
+	assert.NoError(t, err)
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i%50)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	// 限速使合并持续一段时间，关闭时等待合并结束
+	db.config.MergePolicy.RateLimit = 128 << 10
+	merged := make(chan error, 1)
+	go func() {
+		merged <- db.Merge(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, db.Close())
+	select {
+	case err := <-merged:
+		assert.NoError(t, err)
+	default:
+		t.Fatal("close returned before merge finished")
+	}
+	assert.Equal(t, ErrDatabaseClosed, db.Close())
+	assert.Equal(t, ErrDatabaseClosed, db.Merge(context.Background()))
+	// 关闭前已经进入管道的写请求在关闭后才被取出
+	req := &writeReq{mode: internal.ModePut, key: []byte("key0"), value: []byte("late"), done: make(chan error, 1)}
+	db.commitGroup([]*writeReq{req})
+	assert.Equal(t, ErrDatabaseClosed, <-req.done)
+
+	db, err = Open(testDir)
+	assert.NoError(t, err)
+	for i := 150; i < 200; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key%v", i%50)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+	}
+	assert.NoError(t, db.Close())
+}
+
+func TestReadOnly(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	_, err = Open(filepath.Join(testDir, "missing"), WithReadOnly())
+	assert.True(t, os.IsNotExist(err))
+
+	db, err := Open(testDir, WithMaxFileSize(1024))
+	assert.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	assert.NoError(t, db.Close())
+
+	// 记录目录下所有文件的内容与修改时间
+	dump := func() map[string]string {
+		fs, err := ioutil.ReadDir(testDir)
+		assert.NoError(t, err)
+		files := make(map[string]string)
+		for _, f := range fs {
+			buf, err := ioutil.ReadFile(filepath.Join(testDir, f.Name()))
+			assert.NoError(t, err)
+			files[f.Name()] = fmt.Sprintf("%v|%x", f.ModTime().UnixNano(), buf)
+		}
+		return files
+	}
+	before := dump()
+
+	db, err = Open(testDir, WithReadOnly())
+	assert.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+	}
+	assert.Equal(t, ErrReadOnly, db.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrReadOnly, db.PutWithTTL([]byte("key"), []byte("value"), time.Hour))
+	assert.Equal(t, ErrReadOnly, db.Expire([]byte("key0"), time.Hour))
+	assert.Equal(t, ErrReadOnly, db.Delete([]byte("key0")))
+	b := NewBatch()
+	b.Put([]byte("key"), []byte("value"))
+	assert.Equal(t, ErrReadOnly, db.WriteBatch(b))
+	assert.Equal(t, ErrReadOnly, db.Merge(context.Background()))
+	snap, err := db.Snapshot()
+	assert.NoError(t, err)
+	assert.True(t, snap.Has([]byte("key39")))
+	assert.NoError(t, snap.Close())
+	assert.NoError(t, db.Close())
+
+	assert.Equal(t, before, dump())
+}
+
+func TestSyncMode(t *testing.T) {
+	_, err := Open(os.TempDir(), WithPeriodicSync(0))
+	assert.Equal(t, ErrInvalidSyncOption, err)
+
+	options := map[string]Option{
+		"none":     WithConfig(DefaultConfig),
+		"always":   WithSyncAlways(),
+		"group":    WithGroupCommit(2 * time.Millisecond),
+		"periodic": WithPeriodicSync(5 * time.Millisecond),
+	}
+	for name, option := range options {
+		t.Run(name, func(t *testing.T) {
+			testDir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(t, err)
+			defer os.RemoveAll(testDir)
+
+			db, err := Open(testDir, WithMaxFileSize(1024), option)
+			assert.NoError(t, err)
+			db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 10; i++ {
+						assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v-%v", w, i)), []byte("value")))
+					}
+					assert.NoError(t, db.Delete([]byte(fmt.Sprintf("key%v-0", w))))
+				}(w)
+			}
+			wg.Wait()
+			b := NewBatch()
+			b.Put([]byte("batch"), []byte("value"))
+			assert.NoError(t, db.WriteBatch(b))
+			time.Sleep(10 * time.Millisecond)
+			crash(db)
+
+			db, err = Open(testDir)
+			assert.NoError(t, err)
+			assert.Len(t, db.ListKeys(), 8*9+1)
+			assert.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1<<20), WithGroupCommit(time.Millisecond))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	t.Run("group", func(t *testing.T) {
+		// 同一组内的请求按顺序生效，共享一次追加写入
+		reqs := []*writeReq{
+			{mode: internal.ModePut, key: []byte("a"), value: []byte("1"), done: make(chan error, 1)},
+			{mode: internal.ModePut, key: []byte("b"), value: []byte("2"), done: make(chan error, 1)},
+			{mode: internal.ModeDelete, key: []byte("a"), done: make(chan error, 1)},
+			{mode: internal.ModePut, key: []byte("b"), value: []byte("3"), done: make(chan error, 1)},
+		}
+		size := db.curr.Size()
+		db.commitGroup(reqs)
+		for _, req := range reqs {
+			assert.NoError(t, <-req.done)
+			size += req.size()
+		}
+		assert.Equal(t, size, db.curr.Size())
+		assert.False(t, db.Has([]byte("a")))
+		val, err := db.Get([]byte("b"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("3"), val)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for w := 0; w < 16; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v-%v", w, i)), []byte(fmt.Sprintf("value%v", i))))
+				}
+			}(w)
+		}
+		wg.Wait()
+		for w := 0; w < 16; w++ {
+			for i := 0; i < 20; i++ {
+				val, err := db.Get([]byte(fmt.Sprintf("key%v-%v", w, i)))
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("value%v", i)), val)
+			}
+		}
+	})
+}
+
+func TestMergeRecovery(t *testing.T) {
+	setup := func(t *testing.T) (string, *BitCask) {
+		testDir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(t, err)
+		db, err := Open(testDir, WithMaxFileSize(1024))
+		assert.NoError(t, err)
+		db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 40; i++ {
+				assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v:%v", i, round))))
+			}
+		}
+		assert.NoError(t, db.Delete([]byte("key3")))
+		return testDir, db
+	}
+	check := func(t *testing.T, testDir string) {
+		db, err := Open(testDir)
+		assert.NoError(t, err)
+		for i := 0; i < 40; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			if i == 3 {
+				assert.Equal(t, ErrSpecifyKeyNotExist, err)
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v:1", i)), val)
+		}
+		assert.False(t, utils.Exist(filepath.Join(testDir, MergeTmpFolder)))
+		assert.NoError(t, db.Close())
+	}
+	// prepare 执行合并直到写入清单之前
+	prepare := func(t *testing.T, db *BitCask) (string, *mergeManifest) {
+		files, minSeq, err := db.prepareMerge()
+		assert.NoError(t, err)
+		mergePath := filepath.Join(db.path, MergeTmpFolder)
+		res, err := db.newTmpMergeDB(context.Background(), mergePath, files, minSeq, &MergeProgress{})
+		assert.NoError(t, err)
+		m, err := newMergeManifest(mergePath, res.fids)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, m.Files)
+		return mergePath, m
+	}
+
+	t.Run("without manifest", func(t *testing.T) {
+		testDir, db := setup(t)
+		defer os.RemoveAll(testDir)
+		prepare(t, db)
+		crash(db)
+		check(t, testDir)
+	})
+
+	t.Run("remove phase", func(t *testing.T) {
+		testDir, db := setup(t)
+		defer os.RemoveAll(testDir)
+		mergePath, m := prepare(t, db)
+		assert.NoError(t, writeMergeManifest(mergePath, m))
+		// 删除部分旧文件后宕机
+		assert.NoError(t, os.Remove(filepath.Join(testDir, "0.data")))
+		crash(db)
+
+		_, err := Open(testDir, WithReadOnly())
+		assert.Equal(t, ErrMergeInterrupted, err)
+		check(t, testDir)
+	})
+
+	t.Run("move phase", func(t *testing.T) {
+		testDir, db := setup(t)
+		defer os.RemoveAll(testDir)
+		mergePath, m := prepare(t, db)
+		assert.NoError(t, removeMergedFiles(testDir, m.Merged))
+		m.Phase = mergePhaseMove
+		assert.NoError(t, writeMergeManifest(mergePath, m))
+		// 移入部分合并后的文件后宕机
+		assert.NoError(t, os.Rename(filepath.Join(mergePath, m.Files[0]), filepath.Join(testDir, m.Files[0])))
+		crash(db)
+		check(t, testDir)
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		testDir, db := setup(t)
+		defer os.RemoveAll(testDir)
+		assert.NoError(t, db.Merge(context.Background()))
+		assert.NoError(t, db.Close())
+		check(t, testDir)
+	})
+}
+
+func TestOnlineMerge(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	db, err := Open(testDir, WithMaxFileSize(1024))
+	assert.NoError(t, err)
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 40; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v:%v", i, round))))
+		}
+	}
+
+	t.Run("rewritten during merge", func(t *testing.T) {
+		files, minSeq, err := db.prepareMerge()
+		assert.NoError(t, err)
+		mergePath := filepath.Join(testDir, MergeTmpFolder)
+		res, err := db.newTmpMergeDB(context.Background(), mergePath, files, minSeq, &MergeProgress{})
+		assert.NoError(t, err)
+		// 合并结果产生后、切换之前的写入不会被合并结果覆盖
+		assert.NoError(t, db.Put([]byte("key0"), []byte("new")))
+		assert.NoError(t, db.Delete([]byte("key1")))
+		assert.NoError(t, db.PutWithTTL([]byte("key2"), []byte("ttl"), time.Hour))
+		assert.NoError(t, db.commitMerge(mergePath, res))
+
+		verify := func(db *BitCask) {
+			val, err := db.Get([]byte("key0"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("new"), val)
+			assert.False(t, db.Has([]byte("key1")))
+			val, err = db.Get([]byte("key2"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("ttl"), val)
+			for i := 3; i < 40; i++ {
+				val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("value:%v:1", i)), val)
+			}
+		}
+		verify(db)
+		assert.NoError(t, db.Close())
+		db, err = Open(testDir, WithMaxFileSize(1024))
+		assert.NoError(t, err)
+		db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+		verify(db)
+	})
+
+	t.Run("concurrent traffic", func(t *testing.T) {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					// 每个写入者至少写完一轮全部key
+					if i >= 40 {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+					}
+					key := []byte(fmt.Sprintf("key%v", (w*10+i)%40))
+					assert.NoError(t, db.Put(key, []byte(fmt.Sprintf("writer%v", w))))
+					_, err := db.Get(key)
+					assert.NoError(t, err)
+				}
+			}(w)
+		}
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, db.Merge(context.Background()))
+		}
+		close(stop)
+		wg.Wait()
+		for i := 0; i < 40; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Contains(t, string(val), "writer")
+		}
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestMerge(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	var reports []MergeProgress
+	db, err := Open(testDir, WithMaxFileSize(1024), WithMergeRatio(0.3), WithMergeProgress(func(p MergeProgress) {
+		reports = append(reports, p)
+	}))
+	assert.NoError(t, err)
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	// 每个文件中都有一半左右的无效记录，全部参与合并
+	for i := 0; i < 40; i++ {
+		for round := 0; round < 2; round++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v:%v", i, round))))
+		}
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Delete([]byte(fmt.Sprintf("key%v", i))))
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		reports = nil
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Equal(t, context.Canceled, db.Merge(ctx))
+		_, err := os.Stat(filepath.Join(testDir, MergeTmpFolder))
+		assert.True(t, os.IsNotExist(err))
+		last := reports[len(reports)-1]
+		assert.True(t, last.Done)
+		assert.Equal(t, context.Canceled, last.Err)
+		for i := 10; i < 40; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v:1", i)), val)
+		}
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		reports = nil
+		assert.NoError(t, db.Merge(context.Background()))
+		last := reports[len(reports)-1]
+		assert.True(t, last.Done)
+		assert.NoError(t, last.Err)
+		assert.True(t, last.FilesTotal > 1)
+		assert.Equal(t, last.FilesTotal, last.FilesProcessed)
+		assert.Equal(t, int64(30), last.KeysRewritten)
+		assert.True(t, last.BytesReclaimed > 0)
+		// 每处理完一个文件报告一次，最后报告合并结果
+		assert.Equal(t, last.FilesTotal+1, len(reports))
+		for i, p := range reports[:len(reports)-1] {
+			assert.Equal(t, i+1, p.FilesProcessed)
+			assert.False(t, p.Done)
+		}
+		for i := 0; i < 40; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			if i < 10 {
+				assert.Equal(t, ErrSpecifyKeyNotExist, err)
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v:1", i)), val)
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		// 所有文件都被快照引用时没有可合并的文件
+		reports = nil
+		snap, err := db.Snapshot()
+		assert.NoError(t, err)
+		assert.NoError(t, db.Merge(context.Background()))
+		assert.Equal(t, []MergeProgress{{Done: true}}, reports)
+		assert.NoError(t, snap.Close())
+	})
+
+	t.Run("unreferenced files", func(t *testing.T) {
+		// 快照只固定它的key所在的文件，记录全部失效的文件照常合并
+		reports = nil
+		var fids []int
+		for fid := range db.dataFiles {
+			fids = append(fids, fid)
+		}
+		for i := 10; i < 40; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v:2", i))))
+		}
+		snap, err := db.Snapshot()
+		assert.NoError(t, err)
+		for _, fid := range fids {
+			assert.NotContains(t, snap.files, fid)
+		}
+		assert.NoError(t, db.Merge(context.Background()))
+		last := reports[len(reports)-1]
+		assert.NoError(t, last.Err)
+		assert.True(t, last.FilesTotal >= len(fids))
+		assert.True(t, last.BytesReclaimed > 0)
+		for i := 10; i < 40; i++ {
+			val, err := snap.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v:2", i)), val)
+		}
+		assert.NoError(t, snap.Close())
+	})
+	assert.NoError(t, db.Close())
+
+	t.Run("ttl keys", func(t *testing.T) {
+		// 合并期间key不断过期，清理协程只清理数据库本身，临时合并db不启动后台协程
+		testDir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		db, err := Open(testDir, WithMaxFileSize(1024), WithMergeRatio(0.1), WithSweepInterval(time.Millisecond))
+		assert.NoError(t, err)
+		db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+		// 限速使合并持续一段时间
+		db.config.MergePolicy.RateLimit = 256 << 10
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, db.PutWithTTL([]byte(fmt.Sprintf("ttl%v", i)), []byte("value"), time.Duration(i)*time.Millisecond/2+20*time.Millisecond))
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i%50)), []byte(fmt.Sprintf("value:%v", i))))
+		}
+		assert.NoError(t, db.Merge(context.Background()))
+		time.Sleep(150 * time.Millisecond)
+		for i := 0; i < 200; i++ {
+			assert.False(t, db.Has([]byte(fmt.Sprintf("ttl%v", i))))
+		}
+		for i := 150; i < 200; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i%50)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+		}
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestFileStats(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	open := func() *BitCask {
+		db, err := Open(testDir, WithMaxFileSize(1024))
+		assert.NoError(t, err)
+		db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+		return db
+	}
+	// 每个数据文件的统计都覆盖了整个文件
+	checkSize := func(db *BitCask) {
+		files := map[int]int64{db.curr.FileID(): db.curr.Size()}
+		for fid, f := range db.dataFiles {
+			files[fid] = f.Size()
+		}
+		for fid, size := range files {
+			assert.Equal(t, size, db.metadata.Stat(fid).Size(), "file %v", fid)
+		}
+	}
+	db := open()
+	// 冷数据几乎没有无效记录，热点key不断被覆盖
+	assert.NoError(t, db.Put([]byte("victim"), []byte("value")))
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("cold%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	cold := db.curr.FileID()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Put([]byte("hot"), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	assert.NoError(t, db.Delete([]byte("victim")))
+	assert.NoError(t, db.PutWithTTL([]byte("ttl"), []byte("value"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	db.evictExpired()
+	checkSize(db)
+	victim := db.metadata.Stat(0)
+	assert.True(t, victim.Dead > 0 && victim.GarbageRatio() < 0.5)
+	assert.True(t, db.metadata.Stat(db.curr.FileID()).GarbageRatio() > 0.9)
+
+	t.Run("persist", func(t *testing.T) {
+		stats := db.metadata.Files
+		assert.NoError(t, db.Close())
+		db = open()
+		assert.Equal(t, stats, db.metadata.Files)
+		// 宕机后重新统计得到同样的结果
+		crash(db)
+		db = open()
+		assert.Equal(t, stats, db.metadata.Files)
+		checkSize(db)
+	})
+
+	t.Run("selective merge", func(t *testing.T) {
+		sizes := make(map[int]int64)
+		for fid := 0; fid < cold; fid++ {
+			sizes[fid] = db.dataFiles[fid].Size()
+		}
+		assert.NoError(t, db.Merge(context.Background()))
+		checkSize(db)
+		// 冷数据文件没有被重写
+		for fid, size := range sizes {
+			assert.Equal(t, size, db.dataFiles[fid].Size())
+		}
+		for fid, stat := range db.metadata.Files {
+			assert.False(t, stat.Reclaimable(db.config.MergePolicy.MinGarbageRatio), "file %v", fid)
+		}
+		verify := func(db *BitCask) {
+			val, err := db.Get([]byte("hot"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value:99"), val)
+			// 删除记录被保留，冷数据文件中的旧记录不会复活
+			assert.False(t, db.Has([]byte("victim")))
+			assert.False(t, db.Has([]byte("ttl")))
+			for i := 0; i < 40; i++ {
+				assert.True(t, db.Has([]byte(fmt.Sprintf("cold%v", i))))
+			}
+		}
+		verify(db)
+		stats := db.metadata.Files
+		assert.NoError(t, db.Close())
+		db = open()
+		verify(db)
+		crash(db)
+		db = open()
+		verify(db)
+		assert.Equal(t, stats, db.metadata.Files)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("expired keys", func(t *testing.T) {
+		// 合并丢弃的过期key随旧文件一起删除，过期清理不能再计入复用了旧id的合并文件
+		db = open()
+		// 过期key所在的文件都有足够的无效记录参与合并
+		db.config.MergePolicy.MinGarbageRatio = 0.1
+		for i := 0; i < 40; i++ {
+			assert.NoError(t, db.PutWithTTL([]byte(fmt.Sprintf("ttl%v", i)), []byte("value"), 5*time.Millisecond))
+			assert.NoError(t, db.Put([]byte("hot"), []byte(fmt.Sprintf("value:%v", i))))
+		}
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, db.Merge(context.Background()))
+		for i := 0; i < 40; i++ {
+			assert.False(t, db.indexer.Has([]byte(fmt.Sprintf("ttl%v", i))))
+		}
+		stats := make(map[int]internal.FileStat)
+		for fid, stat := range db.metadata.Files {
+			stats[fid] = *stat
+		}
+		db.evictExpired()
+		for fid, stat := range db.metadata.Files {
+			assert.Equal(t, stats[fid], *stat, "file %v", fid)
+		}
+		checkSize(db)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestMergePolicy(t *testing.T) {
+	t.Run("schedule", func(t *testing.T) {
+		p := MergePolicy{Windows: []MergeWindow{{22 * time.Hour, 6 * time.Hour}, {12 * time.Hour, 13 * time.Hour}}}
+		at := func(h, m int) time.Time {
+			return time.Date(2024, 1, 1, h, m, 0, 0, time.Local)
+		}
+		cases := []struct {
+			now          time.Time
+			wait, remain time.Duration
+		}{
+			{at(23, 0), 0, 7 * time.Hour},
+			{at(1, 0), 0, 5 * time.Hour},
+			{at(7, 0), 5 * time.Hour, 0},
+			{at(12, 30), 0, 30 * time.Minute},
+			{at(13, 0), 9 * time.Hour, 0},
+		}
+		for _, c := range cases {
+			wait, remain := p.schedule(c.now, time.Time{})
+			assert.Equal(t, c.wait, wait, c.now.String())
+			assert.Equal(t, c.remain, remain, c.now.String())
+		}
+		// 冷却期内等待冷却结束
+		p.Cooldown = time.Minute
+		wait, _ := p.schedule(at(23, 0), at(23, 0).Add(-10*time.Second))
+		assert.Equal(t, 50*time.Second, wait)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, p := range []MergePolicy{
+			{MinGarbageRatio: 0},
+			{MinGarbageRatio: 0.5, RateLimit: -1},
+			{MinGarbageRatio: 0.5, Windows: []MergeWindow{{time.Hour, time.Hour}}},
+			{MinGarbageRatio: 0.5, Windows: []MergeWindow{{time.Hour, 25 * time.Hour}}},
+		} {
+			_, err := Open(os.TempDir(), WithMergePolicy(p))
+			assert.Equal(t, ErrInvalidMergePolicy, err)
+		}
+	})
+
+	background := func(t *testing.T, windows []MergeWindow) chan MergeProgress {
+		testDir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(testDir) })
+		done := make(chan MergeProgress, 16)
+		db, err := Open(testDir, WithMaxFileSize(1024), WithMergePolicy(MergePolicy{
+			MinGarbageRatio: 0.5,
+			MinDeadBytes:    1024,
+			Windows:         windows,
+		}), WithMergeProgress(func(p MergeProgress) {
+			if p.Done {
+				done <- p
+			}
+		}))
+		assert.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, db.Put([]byte("hot"), []byte(fmt.Sprintf("value:%v", i))))
+		}
+		return done
+	}
+
+	t.Run("background", func(t *testing.T) {
+		done := background(t, nil)
+		select {
+		case p := <-done:
+			assert.NoError(t, p.Err)
+			assert.True(t, p.BytesReclaimed > 1024)
+		case <-time.After(2 * time.Second):
+			t.Fatal("background merge not started")
+		}
+	})
+
+	t.Run("outside window", func(t *testing.T) {
+		now := time.Now()
+		offset := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+		window := MergeWindow{Start: (offset + time.Hour) % day, End: (offset + 2*time.Hour) % day}
+		done := background(t, []MergeWindow{window})
+		select {
+		case <-done:
+			t.Fatal("merge started outside window")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		l := newRateLimiter(10000)
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, l.wait(context.Background(), 100))
+		}
+		assert.True(t, time.Since(start) >= 90*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Equal(t, context.Canceled, l.wait(ctx, 10000))
+	})
+}
+
+func TestMeta(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	readMeta := func() *dbMeta {
+		buf, err := ioutil.ReadFile(filepath.Join(testDir, MetaFile))
+		assert.NoError(t, err)
+		m := &dbMeta{}
+		assert.NoError(t, json.Unmarshal(buf, m))
+		return m
+	}
+	db, err := Open(testDir, WithMaxKeySize(16))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte("value")))
+	}
+	// 打开期间标记为未正常关闭
+	m := readMeta()
+	assert.Equal(t, FormatVersion, m.Version)
+	assert.Equal(t, uint32(16), m.Config.MaxKeySize)
+	assert.False(t, m.Clean)
+	assert.NoError(t, db.Close())
+	m = readMeta()
+	assert.True(t, m.Clean)
+	assert.Equal(t, uint64(10), m.Seq)
+	assert.Equal(t, db.metadata.Files, m.Stats.Files)
+
+	t.Run("incompatible config", func(t *testing.T) {
+		_, err := Open(testDir, WithMaxKeySize(8))
+		assert.Equal(t, &ErrIncompatibleConfig{Option: "MaxKeySize", Stored: 16, Given: 8}, err)
+		// 放宽的限制被记录下来，之后不能再收紧
+		db, err := Open(testDir, WithMaxKeySize(32))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put([]byte("a-key-longer-than-16"), []byte("value")))
+		assert.NoError(t, db.Close())
+		assert.Equal(t, uint32(32), readMeta().Config.MaxKeySize)
+		_, err = Open(testDir, WithMaxKeySize(16))
+		assert.Error(t, err)
+		_, err = Open(testDir, WithMaxKeySize(32), WithMaxValueSize(1))
+		assert.IsType(t, &ErrIncompatibleConfig{}, err)
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		m := readMeta()
+		m.Version = FormatVersion + 1
+		buf, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(testDir, MetaFile), buf, 0600))
+		_, err = Open(testDir, WithMaxKeySize(32))
+		assert.Equal(t, ErrIncompatibleVersion, err)
+		m.Version = FormatVersion
+		buf, err = json.Marshal(m)
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(testDir, MetaFile), buf, 0600))
+	})
+
+	t.Run("legacy seq file", func(t *testing.T) {
+		// 旧版本只有序号文件，打开时迁移到元数据文件
+		assert.NoError(t, os.Remove(filepath.Join(testDir, MetaFile)))
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, 100)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(testDir, SeqFile), buf, 0600))
+		db, err := Open(testDir, WithMaxKeySize(32))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(100), db.seq)
+		assert.False(t, utils.Exist(filepath.Join(testDir, SeqFile)))
+		assert.NoError(t, db.Close())
+		assert.Equal(t, uint64(100), readMeta().Seq)
+	})
+
+	t.Run("missing meta", func(t *testing.T) {
+		// 当前格式的数据库丢失元数据文件，不能被当作最初版本升级
+		assert.NoError(t, os.Remove(filepath.Join(testDir, MetaFile)))
+		v0, err := isV0(testDir)
+		assert.NoError(t, err)
+		assert.False(t, v0)
+		_, err = Check(testDir)
+		assert.NoError(t, err)
+		db, err := Open(testDir, WithMaxKeySize(32))
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value"), val)
+		}
+		assert.NoError(t, db.Close())
+		assert.Equal(t, FormatVersion, readMeta().Version)
+	})
+}
+
+func TestTornWrite(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+
+	var reports []TailRecovery
+	open := func() *BitCask {
+		db, err := Open(testDir, WithRecoveryHandler(func(r TailRecovery) {
+			reports = append(reports, r)
+		}))
+		assert.NoError(t, err)
+		return db
+	}
+	db := open()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	fp := filepath.Join(testDir, fmt.Sprintf("%v%v", db.curr.FileID(), DataFileExt))
+	crash(db)
+	// tear 向活跃文件末尾追加数据后模拟宕机，重新打开
+	tear := func(t *testing.T, tail []byte) (*BitCask, int64) {
+		f, err := os.OpenFile(fp, os.O_WRONLY|os.O_APPEND, 0640)
+		assert.NoError(t, err)
+		_, err = f.Write(tail)
+		assert.NoError(t, err)
+		stat, err := f.Stat()
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		reports = nil
+		return open(), stat.Size()
+	}
+	verify := func(t *testing.T, db *BitCask, n int) {
+		for i := 0; i < n; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+		}
+	}
+
+	t.Run("partial header", func(t *testing.T) {
+		db, size := tear(t, []byte("torn write"))
+		assert.Equal(t, []TailRecovery{{FileID: db.curr.FileID(), Offset: size - 10, Discarded: 10}}, reports)
+		assert.Equal(t, size-10, db.curr.Size())
+		verify(t, db, 10)
+		crash(db)
+	})
+
+	t.Run("partial entry", func(t *testing.T) {
+		buf := internal.NewEntry([]byte("key10"), []byte("value:10"), internal.ModePut, 100).Encode()
+		db, size := tear(t, buf[:len(buf)-3])
+		assert.Equal(t, int64(len(buf)-3), reports[0].Discarded)
+		assert.Equal(t, size-int64(len(buf)-3), db.curr.Size())
+		assert.False(t, db.Has([]byte("key10")))
+		crash(db)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		buf := internal.NewEntry([]byte("key10"), []byte("value:10"), internal.ModePut, 100).Encode()
+		buf[len(buf)-1] ^= 0xff
+		db, _ := tear(t, append(buf, []byte("garbage")...))
+		assert.Equal(t, int64(len(buf)+7), reports[0].Discarded)
+		assert.False(t, db.Has([]byte("key10")))
+		verify(t, db, 10)
+		// 截断后继续追加写入，重新打开不再需要恢复
+		assert.NoError(t, db.Put([]byte("key10"), []byte("value:10")))
+		assert.NoError(t, db.Close())
+		reports = nil
+		db = open()
+		assert.Empty(t, reports)
+		verify(t, db, 11)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("corrupt in the middle", func(t *testing.T) {
+		// 损坏的记录之后还有完好的记录，不是写了一半的尾部，不能截断
+		buf, err := ioutil.ReadFile(fp)
+		assert.NoError(t, err)
+		buf[internal.EntryHeaderSize+2] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(fp, buf, 0640))
+		reports = nil
+		_, err = Open(testDir)
+		var corrupt *ErrCorruptEntry
+		assert.True(t, errors.As(err, &corrupt))
+		assert.Equal(t, int64(0), corrupt.Offset)
+		assert.True(t, errors.Is(err, ErrRepairRequired))
+		assert.Empty(t, reports)
+		stat, err := os.Stat(fp)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(buf)), stat.Size())
+
+		// 修复后只丢失损坏的记录
+		_, err = Repair(testDir)
+		assert.NoError(t, err)
+		db := open()
+		assert.Empty(t, reports)
+		assert.False(t, db.Has([]byte("key0")))
+		for i := 1; i < 11; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+		}
+		assert.NoError(t, db.Close())
+	})
+}
+
+// v0Entry 按最初版本的格式编码记录：20字节记录头，crc只覆盖value，删除记录的value为空
+func v0Entry(key, value []byte) []byte {
+	buf := make([]byte, v0HeaderSize+len(key)+len(value))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(value))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(time.Now().Unix()))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(len(value)))
+	copy(buf[v0HeaderSize:], key)
+	copy(buf[v0HeaderSize+len(key):], value)
+	return buf
+}
+
+func TestChecksum(t *testing.T) {
+	t.Run("crc32c", func(t *testing.T) {
+		testDir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		_, err = Open(testDir, WithChecksum(ChecksumType(9)))
+		assert.Equal(t, ErrInvalidChecksumType, err)
+
+		db, err := Open(testDir, WithChecksum(ChecksumCRC32C))
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+		}
+		assert.NoError(t, db.Close())
+		// 每条记录自带校验算法，换用其他算法重新打开后两种记录都能读取
+		db, err = Open(testDir)
+		assert.NoError(t, err)
+		for i := 10; i < 20; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+		}
+		for i := 0; i < 20; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+		}
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("v0 format", func(t *testing.T) {
+		// 最初版本没有元数据文件，只在关闭时保存gob编码的索引文件
+		write := func(testDir string, withIndex bool) {
+			var buf []byte
+			index := make(map[string]internal.Item)
+			for i := 0; i < 10; i++ {
+				buf = append(buf, v0Entry([]byte(fmt.Sprintf("key%v", i)), []byte("stale"))...)
+			}
+			for i := 0; i < 10; i++ {
+				e := v0Entry([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i)))
+				index[fmt.Sprintf("key%v", i)] = internal.Item{FileID: 0, ValueSize: len(e), ValuePos: int64(len(buf))}
+				buf = append(buf, e...)
+			}
+			buf = append(buf, v0Entry([]byte("key0"), nil)...)
+			delete(index, "key0")
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(testDir, "0"+DataFileExt), buf, 0640))
+			if withIndex {
+				f, err := os.Create(filepath.Join(testDir, IndexFile))
+				assert.NoError(t, err)
+				assert.NoError(t, gob.NewEncoder(f).Encode(index))
+				assert.NoError(t, f.Close())
+			}
+		}
+		for _, withIndex := range []bool{true, false} {
+			testDir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(t, err)
+			defer os.RemoveAll(testDir)
+			write(testDir, withIndex)
+
+			// 只读模式不能重写数据文件
+			_, err = Open(testDir, WithReadOnly())
+			assert.Equal(t, ErrUpgradeRequired, err)
+			_, err = Check(testDir)
+			assert.Equal(t, ErrUpgradeRequired, err)
+			// 修复不能把最初版本的记录当作损坏隔离
+			_, err = Repair(testDir)
+			assert.Equal(t, ErrUpgradeRequired, err)
+			assert.False(t, utils.Exist(filepath.Join(testDir, QuarantineDir)))
+
+			verify := func(db *BitCask) {
+				assert.False(t, db.Has([]byte("key0")))
+				for i := 1; i < 10; i++ {
+					val, err := db.Get([]byte(fmt.Sprintf("key%v", i)))
+					assert.NoError(t, err)
+					assert.Equal(t, []byte(fmt.Sprintf("value:%v", i)), val)
+				}
+				assert.Len(t, db.ListKeys(), 9)
+			}
+			db, err := Open(testDir)
+			assert.NoError(t, err)
+			verify(db)
+			assert.Equal(t, uint64(9), db.seq)
+			assert.False(t, utils.Exist(filepath.Join(testDir, IndexFile)))
+			assert.False(t, utils.Exist(filepath.Join(testDir, MergeTmpFolder)))
+			for _, f := range db.dataFiles {
+				assert.NoError(t, f.Scan(0, func(e *internal.Entry, offset int64, size int) error {
+					assert.True(t, e.IsValid())
+					return nil
+				}))
+			}
+			assert.NoError(t, db.Close())
+
+			db, err = Open(testDir, WithReadOnly())
+			assert.NoError(t, err)
+			verify(db)
+			assert.NoError(t, db.Close())
+			report, err := Check(testDir)
+			assert.NoError(t, err)
+			assert.True(t, report.OK())
+		}
+	})
+}
+
+func TestCorruptEntry(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	db, err := Open(testDir)
+	assert.NoError(t, err)
+	defer db.Close()
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	// corrupt 直接修改磁盘上的记录，返回记录所在的位置
+	corrupt := func(key string, f func(fp string, item internal.Item)) internal.Item {
+		item, ok := db.indexer.Get([]byte(key))
+		assert.True(t, ok)
+		f(filepath.Join(testDir, fmt.Sprintf("%v%v", item.FileID, DataFileExt)), item)
+		return item
+	}
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		item := corrupt("key1", func(fp string, item internal.Item) {
+			f, err := os.OpenFile(fp, os.O_WRONLY, 0640)
+			assert.NoError(t, err)
+			_, err = f.WriteAt([]byte("X"), item.ValuePos+int64(item.ValueSize)-1)
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+		})
+		_, err := db.Get([]byte("key1"))
+		assert.Equal(t, &ErrCorruptEntry{FileID: item.FileID, Offset: item.ValuePos, Err: ErrInvalidCheckSum}, err)
+		assert.True(t, errors.Is(err, ErrInvalidCheckSum))
+		// 快照读取同样报告损坏的位置
+		snap, err := db.Snapshot()
+		assert.NoError(t, err)
+		_, err = snap.Get([]byte("key1"))
+		assert.IsType(t, &ErrCorruptEntry{}, err)
+		snap.Close()
+	})
+
+	t.Run("corrupt header", func(t *testing.T) {
+		item := corrupt("key2", func(fp string, item internal.Item) {
+			f, err := os.OpenFile(fp, os.O_WRONLY, 0640)
+			assert.NoError(t, err)
+			_, err = f.WriteAt([]byte{0xff, 0xff}, item.ValuePos+12)
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+		})
+		_, err := db.Get([]byte("key2"))
+		assert.Equal(t, &ErrCorruptEntry{FileID: item.FileID, Offset: item.ValuePos, Err: ErrTruncatedEntry}, err)
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		item := corrupt("key0", func(fp string, item internal.Item) {
+			assert.NoError(t, os.Truncate(fp, item.ValuePos+int64(item.ValueSize)-1))
+		})
+		_, err := db.Get([]byte("key0"))
+		assert.Equal(t, &ErrCorruptEntry{FileID: item.FileID, Offset: item.ValuePos, Err: ErrTruncatedEntry}, err)
+		// 其他文件中的记录不受影响
+		val, err := db.Get([]byte("key99"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value:99"), val)
+	})
+
+	t.Run("open", func(t *testing.T) {
+		testDir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(t, err)
+		defer os.RemoveAll(testDir)
+		db, err := Open(testDir, WithMaxFileSize(512))
+		assert.NoError(t, err)
+		for i := 0; i < 30; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+		}
+		item, _ := db.indexer.Get([]byte("key3"))
+		last := db.curr.FileID()
+		assert.NoError(t, db.Close())
+		assert.Equal(t, 0, item.FileID)
+		assert.True(t, last > 0)
+
+		// 只读模式不截断文件，最后一个文件末尾写了一半的记录被忽略
+		f, err := os.OpenFile(filepath.Join(testDir, fmt.Sprintf("%v%v", last, DataFileExt)), os.O_WRONLY|os.O_APPEND, 0640)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte("torn"))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		db, err = Open(testDir, WithReadOnly())
+		assert.NoError(t, err)
+		assert.Len(t, db.ListKeys(), 30)
+		assert.NoError(t, db.Close())
+
+		// 不可变文件中记录头的长度超出文件末尾，不能当作写了一半的尾部丢弃之后的记录
+		f, err = os.OpenFile(filepath.Join(testDir, "0"+DataFileExt), os.O_WRONLY, 0640)
+		assert.NoError(t, err)
+		_, err = f.WriteAt([]byte{0xff, 0xff}, item.ValuePos+18)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		for _, options := range [][]Option{nil, {WithReadOnly()}} {
+			_, err = Open(testDir, options...)
+			assert.Equal(t, &ErrCorruptEntry{FileID: 0, Offset: item.ValuePos, Err: ErrTruncatedEntry}, err)
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	db, err := Open(testDir, WithMergeRatio(0.3))
+	assert.NoError(t, err)
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte("stale")))
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	assert.NoError(t, db.Delete([]byte("key0")))
+	assert.NoError(t, db.Merge(context.Background()))
+	batch := NewBatch()
+	batch.Put([]byte("batch:1"), []byte("value"))
+	batch.Put([]byte("batch:2"), []byte("value"))
+	assert.NoError(t, db.WriteBatch(batch))
+	for i := 50; i < 100; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	// 打开期间不能检查
+	_, err = Check(testDir)
+	assert.IsType(t, &ErrDatabaseLocked{}, err)
+	hinted, ok := db.indexer.Get([]byte("key1"))
+	assert.True(t, ok)
+	corrupted, ok := db.indexer.Get([]byte("key60"))
+	assert.True(t, ok)
+	last := db.curr.FileID()
+	assert.NoError(t, db.Close())
+
+	report, err := Check(testDir)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, len(db.dataFiles)+1, report.Files)
+	assert.True(t, report.Hints > 0)
+
+	// 损坏一条记录，活跃文件末尾留下未提交的批量记录，截断一个hint文件
+	f, err := os.OpenFile(filepath.Join(testDir, fmt.Sprintf("%v%v", corrupted.FileID, DataFileExt)), os.O_WRONLY, 0640)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, corrupted.ValuePos+12)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	orphan := internal.NewEntry([]byte("batch:3"), []byte("value"), internal.ModePut|internal.ModeBatch, 1000).Encode()
+	f, err = os.OpenFile(filepath.Join(testDir, fmt.Sprintf("%v%v", last, DataFileExt)), os.O_WRONLY|os.O_APPEND, 0640)
+	assert.NoError(t, err)
+	_, err = f.Write(orphan)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	hint := hintPath(testDir, hinted.FileID)
+	stat, err := os.Stat(hint)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(hint, stat.Size()-1))
+
+	report, err = Check(testDir)
+	assert.NoError(t, err)
+	kinds := make(map[ProblemKind][]Problem)
+	for _, p := range report.Problems {
+		kinds[p.Kind] = append(kinds[p.Kind], p)
+	}
+	assert.Len(t, report.Problems, 3)
+	// 大小字段损坏后向后找到下一条完整的记录
+	assert.Equal(t, corrupted.FileID, kinds[ProblemCorrupt][0].FileID)
+	assert.Equal(t, corrupted.ValuePos, kinds[ProblemCorrupt][0].Offset)
+	assert.Equal(t, int64(corrupted.ValueSize), kinds[ProblemCorrupt][0].Size)
+	assert.Equal(t, []byte("batch:3"), kinds[ProblemOrphaned][0].Key)
+	assert.Equal(t, hinted.FileID, kinds[ProblemBadHint][0].FileID)
+	// 检查不修改目录
+	_, err = os.Stat(filepath.Join(testDir, QuarantineDir))
+	assert.True(t, os.IsNotExist(err))
+
+	report, err = Repair(testDir)
+	assert.NoError(t, err)
+	assert.Len(t, report.Problems, 3)
+	assert.Equal(t, int64(corrupted.ValueSize+len(orphan)), report.Quarantined)
+	assert.Contains(t, report.Rebuilt, hinted.FileID)
+	report, err = Check(testDir)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.Problems)
+
+	db, err = Open(testDir)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.False(t, db.Has([]byte("key0")))
+	assert.False(t, db.Has([]byte("key60")))
+	assert.False(t, db.Has([]byte("batch:3")))
+	for _, key := range []string{"key1", "key49", "key59", "key61", "key99", "batch:1", "batch:2"} {
+		_, err := db.Get([]byte(key))
+		assert.NoError(t, err, key)
+	}
+}
+
+func TestStats(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testDir)
+	cfg, err := LoadConfig(testDir)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig, cfg)
+
+	db, err := Open(testDir, WithMaxKeySize(128), WithMaxValueSize(0), WithIndexType(OrderedIndex))
+	assert.NoError(t, err)
+	db.config.MergePolicy.MinDeadBytes = math.MaxInt64
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value:%v", i))))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Delete([]byte(fmt.Sprintf("key%v", i))))
+	}
+	assert.NoError(t, db.PutWithTTL([]byte("key10"), []byte("value"), time.Nanosecond))
+	time.Sleep(time.Millisecond)
+	s := db.Stats()
+	assert.Equal(t, 89, s.Keys)
+	assert.Equal(t, len(db.dataFiles)+1, s.DataFiles)
+	assert.Equal(t, uint64(111), s.Seq)
+	assert.True(t, s.DeadBytes > 0 && s.DeadBytes < s.Size)
+	assert.True(t, s.Reclaimable <= s.DeadBytes)
+	assert.NoError(t, db.Close())
+
+	// 按元数据中记录的配置打开
+	cfg, err = LoadConfig(testDir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(128), cfg.MaxKeySize)
+	assert.Equal(t, uint64(0), cfg.MaxValueSize)
+	assert.Equal(t, OrderedIndex, cfg.IndexType)
+	db, err = Open(testDir, WithConfig(cfg), WithReadOnly())
+	assert.NoError(t, err)
+	assert.Equal(t, s.Size, db.Stats().Size)
+	assert.NoError(t, db.Close())
+}
@@ -1,13 +1,90 @@
 package bitcask
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zach030/tiny-bitcask/internal"
+)
 
 var (
-	ErrSpecifyKeyNotExist = errors.New("specify key not exist")
-	ErrEmptyKey           = errors.New("empty key")
-	ErrKeyTooLarge        = errors.New("key too large")
-	ErrValueTooLarge      = errors.New("value too large")
-	ErrInvalidCheckSum    = errors.New("invalid checksum")
+	ErrSpecifyKeyNotExist  = errors.New("specify key not exist")
+	ErrEmptyKey            = errors.New("empty key")
+	ErrKeyTooLarge         = errors.New("key too large")
+	ErrValueTooLarge       = errors.New("value too large")
+	ErrInvalidCheckSum     = errors.New("invalid checksum")
+	ErrTruncatedEntry      = internal.ErrTruncatedEntry
+	ErrCorruptHeader       = internal.ErrCorruptHeader
+	ErrUnknownMode         = errors.New("unknown entry mode")
+	ErrInvalidTTL          = errors.New("ttl must be positive")
+	ErrInvalidBatch        = errors.New("invalid batch commit")
+	ErrInvalidSeqFile      = errors.New("invalid sequence file")
+	ErrInvalidMetaFile     = errors.New("invalid meta file")
+	ErrInvalidChecksumType = errors.New("invalid checksum type")
+	ErrKeyOnlyIterator     = errors.New("value is not available in key-only iterator")
+
+	ErrMergeInProgress      = errors.New("database is in merge progress")
+	ErrMergeInterrupted     = errors.New("database has an interrupted merge, open it writable to recover")
+	ErrInvalidMergeManifest = errors.New("invalid merge manifest")
+	ErrInvalidMergeRatio    = errors.New("merge ratio must be in (0, 1]")
+	ErrInvalidMergePolicy   = errors.New("invalid merge policy")
+	ErrSnapshotActive       = errors.New("data files are pinned by snapshot, merge is postponed")
+	ErrSnapshotClosed       = errors.New("snapshot is closed")
+
+	ErrReadOnly         = errors.New("database is opened read-only")
+	ErrDatabaseNotExist = errors.New("database not exist")
+	ErrDatabaseClosed   = errors.New("database is closed")
 
-	ErrMergeInProgress = errors.New("database is in merge progress")
+	ErrIncompatibleVersion = errors.New("database is created by a newer version")
+	ErrRepairRequired      = errors.New("intact entries follow the corrupt one, run Repair to quarantine it")
+	ErrUpgradeRequired     = errors.New("database is in the original format, open it writable to upgrade")
+
+	ErrInvalidSyncOption = errors.New("invalid sync option")
+
+	ErrConflict    = errors.New("transaction conflict, keys read were changed by others")
+	ErrTxnReadOnly = errors.New("write in read-only transaction")
 )
+
+// ErrDatabaseLocked the database directory is locked by another process
+type ErrDatabaseLocked struct {
+	Path string // database directory
+	PID  int    // pid of the process holding the lock, 0 if held by read-only processes
+}
+
+func (e *ErrDatabaseLocked) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("database %s is locked by read-only process", e.Path)
+	}
+	return fmt.Sprintf("database %s is locked by process %d", e.Path, e.PID)
+}
+
+// ErrCorruptEntry the record at Offset of datafile FileID can not be read, Err is one of
+// ErrInvalidCheckSum, ErrTruncatedEntry and ErrCorruptHeader, or ErrRepairRequired when Open
+// finds a corrupt record in the middle of the active datafile
+type ErrCorruptEntry struct {
+	FileID int
+	Offset int64
+	Err    error
+}
+
+func (e *ErrCorruptEntry) Error() string {
+	return fmt.Sprintf("corrupt entry in datafile %d at offset %d: %v", e.FileID, e.Offset, e.Err)
+}
+
+func (e *ErrCorruptEntry) Unwrap() error {
+	return e.Err
+}
+
+// ErrIncompatibleConfig the option is stricter than the one existing data was written with
+type ErrIncompatibleConfig struct {
+	Option string // name of the config field
+	Stored uint64 // limit recorded in meta file, 0 means unlimited
+	Given  uint64 // limit given on open
+}
+
+func (e *ErrIncompatibleConfig) Error() string {
+	if e.Stored == 0 {
+		return fmt.Sprintf("%s %d is stricter than unlimited existing data was written with", e.Option, e.Given)
+	}
+	return fmt.Sprintf("%s %d is stricter than %d existing data was written with", e.Option, e.Given, e.Stored)
+}
@@ -3,6 +3,7 @@ package datafile
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -18,9 +19,28 @@ var (
 	ErrReadOnlyFile = errors.New("readonly data-datafile")
 )
 
+// EntryError the entry at Offset can not be decoded, Err is internal.ErrTruncatedEntry
+// or internal.ErrCorruptHeader
+type EntryError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("entry at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
 type DataFile interface {
 	Read(offset int64, size int) (*internal.Entry, error) // read entry
+	Scan(offset int64, f ScanFunc) error                  // iterate entries
 	Write(entry *internal.Entry) (int64, int, error)      // write entry
+	WriteAll(entries []*internal.Entry) ([]int64, error)  // write entries in one append
+	Verify() (int64, bool, error)                         // size of intact entries from the beginning, and if the rest is a torn tail
+	Truncate(size int64) error                            // discard data after size
 	FileID() int                                          // get datafile id
 	Size() int64                                          // get datafile size
 	Name() string                                         // get datafile name
@@ -28,6 +48,9 @@ type DataFile interface {
 	Sync() error                                          // sync datafile to disk
 }
 
+// ScanFunc is called for each entry in datafile with its offset and encoded size
+type ScanFunc func(entry *internal.Entry, offset int64, size int) error
+
 // BkFile in disk
 type BkFile struct {
 	sync.RWMutex
@@ -68,12 +91,134 @@ func NewBkFile(path string, id int, active bool) (DataFile, error) {
 	return bf, nil
 }
 
-// Read buf from files: older or active
-func (b *BkFile) Read(offset int64, size int) (entry *internal.Entry, err error) {
+// Read buf from files: older or active. A read stopping short at the end of datafile
+// returns internal.ErrTruncatedEntry.
+func (b *BkFile) Read(offset int64, size int) (*internal.Entry, error) {
 	buf := make([]byte, size)
-	_, err = b.rf.ReadAt(buf, offset)
-	entry = internal.Decode(buf)
-	return
+	n, err := b.rf.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < size {
+		return nil, internal.ErrTruncatedEntry
+	}
+	return internal.Decode(buf)
+}
+
+// Scan iterate entries from offset to the end of datafile. An entry running past the end or with
+// a corrupt header is reported as *EntryError, the caller decides if it is a torn tail to ignore.
+func (b *BkFile) Scan(offset int64, f ScanFunc) error {
+	end := b.Size()
+	header := make([]byte, internal.EntryHeaderSize)
+	for offset < end {
+		if offset+internal.EntryHeaderSize > end {
+			return &EntryError{Offset: offset, Err: internal.ErrTruncatedEntry}
+		}
+		if _, err := b.rf.ReadAt(header, offset); err != nil {
+			return err
+		}
+		keySize, valueSize := internal.DecodeHeader(header)
+		size := int64(internal.EntryHeaderSize) + int64(keySize) + int64(valueSize)
+		if offset+size > end {
+			return &EntryError{Offset: offset, Err: internal.ErrTruncatedEntry}
+		}
+		entry, err := b.Read(offset, int(size))
+		if err == internal.ErrCorruptHeader || err == internal.ErrTruncatedEntry {
+			return &EntryError{Offset: offset, Err: err}
+		}
+		if err != nil {
+			return err
+		}
+		if err = f(entry, offset, int(size)); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// Verify check entries one by one from the beginning: the header is complete, the entry fits in
+// datafile and its checksum matches. The size of intact entries before the first torn or corrupted
+// entry is returned, together with whether the bad entry is a torn tail: it runs to the end of
+// datafile, or no intact entry can be found at any offset after it.
+func (b *BkFile) Verify() (int64, bool, error) {
+	end := b.Size()
+	var offset int64
+	for offset < end {
+		size, ok, err := b.verifyAt(offset, end)
+		if err != nil {
+			return 0, false, err
+		}
+		if !ok {
+			break
+		}
+		offset += size
+	}
+	if offset == end {
+		return offset, true, nil
+	}
+	size, _, err := b.verifyAt(offset, end)
+	if err != nil || offset+size >= end {
+		return offset, err == nil, err
+	}
+	for pos := offset + 1; pos+internal.EntryHeaderSize <= end; pos++ {
+		_, ok, err := b.verifyAt(pos, end)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return offset, false, nil
+		}
+	}
+	return offset, true, nil
+}
+
+// verifyAt check the entry at offset, size is the encoded size declared by its header,
+// or the rest of datafile when the header is incomplete or the entry runs past the end
+func (b *BkFile) verifyAt(offset, end int64) (int64, bool, error) {
+	if offset+internal.EntryHeaderSize > end {
+		return end - offset, false, nil
+	}
+	header := make([]byte, internal.EntryHeaderSize)
+	if _, err := b.rf.ReadAt(header, offset); err != nil {
+		return 0, false, err
+	}
+	keySize, valueSize := internal.DecodeHeader(header)
+	size := int64(internal.EntryHeaderSize) + int64(keySize) + int64(valueSize)
+	if offset+size > end {
+		return end - offset, false, nil
+	}
+	entry, err := b.Read(offset, int(size))
+	if err == internal.ErrCorruptHeader {
+		return size, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return size, entry.IsValid(), nil
+}
+
+// Truncate discard data after size and sync it to disk, used to drop the torn tail of datafile
+func (b *BkFile) Truncate(size int64) error {
+	b.Lock()
+	defer b.Unlock()
+	f, err := os.OpenFile(b.rf.Name(), os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	b.offset = size
+	return nil
 }
 
 // Write entry to active datafile
@@ -92,6 +237,28 @@ func (b *BkFile) Write(entry *internal.Entry) (int64, int, error) {
 	return offset, n, nil
 }
 
+// WriteAll encode entries into one buffer and append it to active datafile,
+// offset of each entry is returned
+func (b *BkFile) WriteAll(entries []*internal.Entry) ([]int64, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.wf == nil {
+		return nil, ErrReadOnlyFile
+	}
+	offsets := make([]int64, len(entries))
+	var buf []byte
+	for i, entry := range entries {
+		offsets[i] = b.offset + int64(len(buf))
+		buf = append(buf, entry.Encode()...)
+	}
+	n, err := b.wf.WriteAt(buf, b.offset)
+	if err != nil {
+		return nil, err
+	}
+	b.offset += int64(n)
+	return offsets, nil
+}
+
 // FileID get current datafile id
 func (b *BkFile) FileID() int {
 	return b.id
@@ -112,6 +279,8 @@ func (b *BkFile) Name() string {
 }
 
 func (b *BkFile) Close() error {
+	b.Lock()
+	defer b.Unlock()
 	defer func() {
 		if b.rf != nil {
 			b.rf.Close()
@@ -120,16 +289,26 @@ func (b *BkFile) Close() error {
 	if b.wf == nil {
 		return nil
 	}
-	err := b.wf.Sync()
+	wf := b.wf
+	b.wf = nil
+	err := wf.Sync()
 	if err != nil {
+		wf.Close()
 		return err
 	}
-	return b.wf.Close()
+	return wf.Close()
 }
 
+// Sync datafile to disk, a closed datafile has been synced on close
 func (b *BkFile) Sync() error {
-	if b.wf == nil {
+	b.RLock()
+	wf := b.wf
+	b.RUnlock()
+	if wf == nil {
 		return nil
 	}
-	return b.wf.Sync()
+	if err := wf.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
 }
@@ -2,75 +2,205 @@ package internal
 
 import (
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
 	"time"
 )
 
 const (
-	EntryHeaderSize = 20
+	EntryHeaderSize = 37
+)
+
+var (
+	ErrTruncatedEntry = errors.New("truncated entry")
+	ErrCorruptHeader  = errors.New("corrupt entry header")
+)
+
+// Mode operation type of entry
+type Mode uint8
+
+const (
+	ModePut         Mode = iota // put key and value
+	ModeDelete                  // tombstone of deleted key
+	ModeBatchCommit             // commit marker of batch, value is the count of entries in batch
+)
+
+// ModeBatch flag of entries written in batch, they take effect only after the commit marker
+const ModeBatch Mode = 0x80
+
+// InBatch if the entry is written in batch
+func (m Mode) InBatch() bool {
+	return m&ModeBatch != 0
+}
+
+// Op operation type without batch flag
+func (m Mode) Op() Mode {
+	return m &^ ModeBatch
+}
+
+// Checksum algorithm of entry checksum
+type Checksum uint8
+
+const (
+	ChecksumIEEE   Checksum = iota // crc32 with IEEE polynomial
+	ChecksumCRC32C                 // crc32 with Castagnoli polynomial, hardware accelerated on most CPUs
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 记录格式标志，保存在mode字节的高位，不属于操作类型
+const (
+	flagCRC32C Mode = 0x20 // crc使用Castagnoli多项式
+	formatMask      = flagCRC32C
 )
 
 // Entry The format for each key/value entry
 type Entry struct {
 	// header
-	crc       uint32 // crc checksum
+	crc       uint32 // crc checksum of the whole entry
 	timestamp int64  // current timestamp
 	keySize   uint32 // size of key
 	valueSize uint32 // size of value
+	mode      Mode   // operation type
+	expiredAt int64  // expire timestamp in unix nano, 0 means never expire
+	seq       uint64 // db-wide monotonic sequence number, the authority of record order
 	// payload
 	key   []byte // key content
 	value []byte // value content
+	// 记录格式，与mode一起编码在mode字节中
+	format Mode
 }
 
 // NewEntry return a format entry
-func NewEntry(key, value []byte) *Entry {
+func NewEntry(key, value []byte, mode Mode, seq uint64) *Entry {
+	return NewEntryWithExpire(key, value, mode, seq, 0)
+}
+
+// NewEntryWithExpire return a format entry which expires at expiredAt
+func NewEntryWithExpire(key, value []byte, mode Mode, seq uint64, expiredAt int64) *Entry {
 	e := &Entry{
 		timestamp: time.Now().Unix(),
 		keySize:   uint32(len(key)),
 		valueSize: uint32(len(value)),
+		mode:      mode,
+		expiredAt: expiredAt,
+		seq:       seq,
 		key:       key,
 		value:     value,
 	}
-	e.crc = crc32.ChecksumIEEE(e.value)
+	e.crc = e.checksum()
+	return e
+}
+
+// WithChecksum use specified algorithm for the checksum of entry
+func (e *Entry) WithChecksum(c Checksum) *Entry {
+	e.format = 0
+	if c == ChecksumCRC32C {
+		e.format = flagCRC32C
+	}
+	e.crc = e.checksum()
 	return e
 }
 
-// encode without crc
-func (e *Entry) encodeWithoutCRC() []byte {
-	buf := make([]byte, 16+len(e.key)+len(e.value))
+// checksum crc覆盖crc之后的整条记录
+func (e *Entry) checksum() uint32 {
+	table := crc32.IEEETable
+	if e.format&flagCRC32C != 0 {
+		table = castagnoliTable
+	}
+	crc := crc32.Update(0, table, e.encodeHeader())
+	crc = crc32.Update(crc, table, e.key)
+	return crc32.Update(crc, table, e.value)
+}
+
+// encodeHeader encode header without crc
+func (e *Entry) encodeHeader() []byte {
+	buf := make([]byte, EntryHeaderSize-4)
 	binary.LittleEndian.PutUint64(buf[0:8], uint64(e.timestamp))
 	binary.LittleEndian.PutUint32(buf[8:12], e.keySize)
 	binary.LittleEndian.PutUint32(buf[12:16], e.valueSize)
-	copy(buf[16:16+len(e.key)], e.key)
-	copy(buf[16+len(e.key):16+len(e.key)+len(e.value)], e.value)
+	buf[16] = byte(e.mode | e.format)
+	binary.LittleEndian.PutUint64(buf[17:25], uint64(e.expiredAt))
+	binary.LittleEndian.PutUint64(buf[25:33], e.seq)
 	return buf
 }
 
 // Encode entry to byte array
 func (e *Entry) Encode() []byte {
-	buf := make([]byte, EntryHeaderSize+len(e.key)+len(e.value))
+	buf := make([]byte, e.Size())
 	binary.LittleEndian.PutUint32(buf[0:4], e.crc)
-	copy(buf[4:], e.encodeWithoutCRC())
+	copy(buf[4:EntryHeaderSize], e.encodeHeader())
+	copy(buf[EntryHeaderSize:], e.key)
+	copy(buf[EntryHeaderSize+len(e.key):], e.value)
 	return buf
 }
 
-// Decode byte array to Entry
-func Decode(buf []byte) (entry *Entry) {
-	entry = &Entry{}
+// Decode byte array to Entry. ErrTruncatedEntry is returned if buf is shorter than the entry
+// its header describes, ErrCorruptHeader if the header does not describe exactly buf.
+func Decode(buf []byte) (*Entry, error) {
+	if len(buf) < EntryHeaderSize {
+		return nil, ErrTruncatedEntry
+	}
+	entry := &Entry{}
 	entry.crc = binary.LittleEndian.Uint32(buf[0:4])
 	entry.timestamp = int64(binary.LittleEndian.Uint64(buf[4:12]))
 	entry.keySize = binary.LittleEndian.Uint32(buf[12:16])
 	entry.valueSize = binary.LittleEndian.Uint32(buf[16:20])
-	entry.key = buf[EntryHeaderSize : EntryHeaderSize+int(entry.keySize)]
-	entry.value = buf[EntryHeaderSize+int(entry.keySize) : EntryHeaderSize+int(entry.keySize)+int(entry.valueSize)]
+	entry.mode = Mode(buf[20]) &^ formatMask
+	entry.format = Mode(buf[20]) & formatMask
+	entry.expiredAt = int64(binary.LittleEndian.Uint64(buf[21:29]))
+	entry.seq = binary.LittleEndian.Uint64(buf[29:37])
+	// 在64位上计算长度，避免损坏的大小字段溢出
+	size := uint64(EntryHeaderSize) + uint64(entry.keySize) + uint64(entry.valueSize)
+	switch {
+	case size > uint64(len(buf)):
+		return nil, ErrTruncatedEntry
+	case size < uint64(len(buf)):
+		return nil, ErrCorruptHeader
+	}
+	keyEnd := EntryHeaderSize + int(entry.keySize)
+	entry.key = buf[EntryHeaderSize:keyEnd]
+	entry.value = buf[keyEnd:]
+	return entry, nil
+}
+
+// DecodeHeader parse key size and value size from entry header
+func DecodeHeader(buf []byte) (keySize, valueSize uint32) {
+	keySize = binary.LittleEndian.Uint32(buf[12:16])
+	valueSize = binary.LittleEndian.Uint32(buf[16:20])
 	return
 }
 
+// Size length of encoded entry
+func (e *Entry) Size() int {
+	return EntryHeaderSize + len(e.key) + len(e.value)
+}
+
+func (e *Entry) Key() []byte {
+	return e.key
+}
+
 func (e *Entry) Value() []byte {
 	return e.value
 }
 
+func (e *Entry) Timestamp() int64 {
+	return e.timestamp
+}
+
+func (e *Entry) Mode() Mode {
+	return e.mode
+}
+
+func (e *Entry) ExpiredAt() int64 {
+	return e.expiredAt
+}
+
+func (e *Entry) Seq() uint64 {
+	return e.seq
+}
+
 // IsValid Check if entry is valid
 func (e *Entry) IsValid() bool {
-	return e.crc == crc32.ChecksumIEEE(e.value)
+	return e.crc == e.checksum()
 }
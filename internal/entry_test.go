@@ -1,22 +1,106 @@
 package internal
 
 import (
+	"encoding/binary"
+	"math"
 	"testing"
 
 	"github.com/go-playground/assert/v2"
 )
 
+// decode 解码完整的记录
+func decode(t *testing.T, buf []byte) *Entry {
+	e, err := Decode(buf)
+	assert.Equal(t, nil, err)
+	return e
+}
+
 func TestEntry(t *testing.T) {
 	t.Run("encode and decode", func(t *testing.T) {
-		entry := NewEntry([]byte("key"), []byte("value"))
+		entry := NewEntry([]byte("key"), []byte("value"), ModePut, 1)
 		buf := entry.Encode()
-		ne := Decode(buf)
+		ne := decode(t, buf)
 		assert.Equal(t, ne, entry)
 	})
 
 	t.Run("valid entry", func(t *testing.T) {
-		entry := NewEntry([]byte("key"), []byte("value"))
+		entry := NewEntry([]byte("key"), []byte("value"), ModePut, 1)
 		entry.value = []byte("value2")
 		assert.Equal(t, false, entry.IsValid())
 	})
+
+	t.Run("tombstone entry", func(t *testing.T) {
+		entry := NewEntry([]byte("key"), nil, ModeDelete, 2)
+		ne := decode(t, entry.Encode())
+		assert.Equal(t, ModeDelete, ne.Mode())
+		assert.Equal(t, true, ne.IsValid())
+		// mode 被 crc 覆盖
+		ne.mode = ModePut
+		assert.Equal(t, false, ne.IsValid())
+	})
+
+	t.Run("entry with expire", func(t *testing.T) {
+		entry := NewEntryWithExpire([]byte("key"), []byte("value"), ModePut, 3, 1234567)
+		ne := decode(t, entry.Encode())
+		assert.Equal(t, ne, entry)
+		assert.Equal(t, int64(1234567), ne.ExpiredAt())
+		ne.expiredAt = 0
+		assert.Equal(t, false, ne.IsValid())
+	})
+
+	t.Run("entry with seq", func(t *testing.T) {
+		entry := NewEntry([]byte("key"), []byte("value"), ModePut, 42)
+		ne := decode(t, entry.Encode())
+		assert.Equal(t, uint64(42), ne.Seq())
+		// seq 被 crc 覆盖
+		ne.seq = 41
+		assert.Equal(t, false, ne.IsValid())
+	})
+
+	t.Run("checksum covers whole record", func(t *testing.T) {
+		entry := NewEntry([]byte("key"), []byte("value"), ModePut, 1)
+		buf := entry.Encode()
+		// 时间戳与key同样被 crc 覆盖
+		buf[4] ^= 0xff
+		assert.Equal(t, false, decode(t, buf).IsValid())
+		buf[4] ^= 0xff
+		buf[EntryHeaderSize] = 'K'
+		assert.Equal(t, false, decode(t, buf).IsValid())
+		buf[EntryHeaderSize] = 'k'
+		assert.Equal(t, true, decode(t, buf).IsValid())
+	})
+
+	t.Run("crc32c entry", func(t *testing.T) {
+		entry := NewEntry([]byte("key"), []byte("value"), ModeDelete|ModeBatch, 7).WithChecksum(ChecksumCRC32C)
+		assert.NotEqual(t, NewEntry([]byte("key"), []byte("value"), ModeDelete|ModeBatch, 7).crc, entry.crc)
+		ne := decode(t, entry.Encode())
+		assert.Equal(t, ne, entry)
+		// 格式标志不属于操作类型
+		assert.Equal(t, ModeDelete|ModeBatch, ne.Mode())
+		assert.Equal(t, true, ne.IsValid())
+		buf := entry.Encode()
+		buf[len(buf)-1] ^= 0xff
+		assert.Equal(t, false, decode(t, buf).IsValid())
+	})
+
+	t.Run("truncated entry", func(t *testing.T) {
+		buf := NewEntry([]byte("key"), []byte("value"), ModePut, 1).Encode()
+		for _, n := range []int{0, EntryHeaderSize - 1, EntryHeaderSize, len(buf) - 1} {
+			_, err := Decode(buf[:n])
+			assert.Equal(t, ErrTruncatedEntry, err)
+		}
+	})
+
+	t.Run("corrupt header", func(t *testing.T) {
+		buf := NewEntry([]byte("key"), []byte("value"), ModePut, 1).Encode()
+		// 头部声明的大小比记录小
+		_, err := Decode(append(buf, 0))
+		assert.Equal(t, ErrCorruptHeader, err)
+		// 损坏的大小字段不会溢出
+		bad := append([]byte(nil), buf...)
+		binary.LittleEndian.PutUint32(bad[12:16], math.MaxUint32)
+		binary.LittleEndian.PutUint32(bad[16:20], math.MaxUint32)
+		_, err = Decode(bad)
+		assert.Equal(t, ErrTruncatedEntry, err)
+	})
 }
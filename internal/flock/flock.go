@@ -0,0 +1,88 @@
+package flock
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrLocked = errors.New("file is locked by another process")
+)
+
+// Flock advisory lock on file between processes
+type Flock struct {
+	f      *os.File
+	shared bool
+}
+
+// New acquire lock on file at path without blocking, ErrLocked is returned if the lock is held
+// by others. Exclusive holder records its pid in the file so that others can report it,
+// shared holder only opens an existing file read-only and never modifies it.
+func New(path string, shared bool) (*Flock, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	if shared {
+		f, err = os.Open(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = lock(f, shared); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := &Flock{f: f, shared: shared}
+	if shared {
+		return l, nil
+	}
+	if err = writePID(f); err != nil {
+		l.Release()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Release the lock, the pid recorded by exclusive holder is cleared
+func (l *Flock) Release() error {
+	if !l.shared {
+		if err := l.f.Truncate(0); err != nil {
+			l.f.Close()
+			return err
+		}
+	}
+	if err := unlock(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// Owner pid of the exclusive holder recorded in lock file, 0 if unknown
+func Owner(path string) int {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
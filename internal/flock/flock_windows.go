@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package flock
+
+import "os"
+
+// flock is not available on windows, the lock file only records the holder's pid
+func lock(f *os.File, shared bool) error {
+	return nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+const (
+	DefaultHintFileName = "%v.hint"
+	HintHeaderSize      = 40
+)
+
+var (
+	ErrCorruptHint = errors.New("corrupt hint entry")
+)
+
+// EncodeHint hint entry: timestamp | key-size | value-size | value-pos | expired-at | seq | key,
+// value-size is 0 for a delete record kept by merge
+func EncodeHint(key string, item internal.Item) []byte {
+	buf := make([]byte, HintHeaderSize+len(key))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(item.TimeStamp))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(item.ValueSize))
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(item.ValuePos))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(item.ExpiredAt))
+	binary.LittleEndian.PutUint64(buf[32:40], item.Seq)
+	copy(buf[HintHeaderSize:], key)
+	return buf
+}
+
+// EncodeTombstone encode the delete record at pos of datafile as hint entry,
+// so it still shadows older records of the key in other datafiles
+func EncodeTombstone(key []byte, pos int64, seq uint64) []byte {
+	return EncodeHint(string(key), internal.Item{ValuePos: pos, Seq: seq})
+}
+
+// IsTombstone if the item read from hint file is a delete record
+func IsTombstone(item internal.Item) bool {
+	return item.ValueSize == 0
+}
+
+// WriteHints write encoded hints of each datafile
+func WriteHints(path string, hints map[int][]byte) error {
+	for fid, buf := range hints {
+		if err := writeHint(path, fid, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHint write hint file to temp file and rename it
+func writeHint(path string, fid int, buf []byte) error {
+	return utils.WriteFileAtomic(filepath.Join(path, fmt.Sprintf(DefaultHintFileName, fid)), buf, 0600)
+}
+
+// ReadHints read every hint entry of specified datafile in order, size is the length of r.
+// ErrCorruptHint is returned if the key size of an entry runs past the end.
+func ReadHints(r io.Reader, size int64, fid int, f func(key []byte, item internal.Item) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, HintHeaderSize)
+	for remain := size; ; {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// hint文件没有校验，先按剩余大小检查key大小再分配
+		keySize := int64(binary.LittleEndian.Uint32(header[8:12]))
+		if remain -= HintHeaderSize; keySize > remain {
+			return ErrCorruptHint
+		}
+		remain -= keySize
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return err
+		}
+		item := internal.Item{
+			FileID:    fid,
+			ValueSize: int(binary.LittleEndian.Uint32(header[12:16])),
+			ValuePos:  int64(binary.LittleEndian.Uint64(header[16:24])),
+			TimeStamp: int64(binary.LittleEndian.Uint64(header[0:8])),
+			ExpiredAt: int64(binary.LittleEndian.Uint64(header[24:32])),
+			Seq:       binary.LittleEndian.Uint64(header[32:40]),
+		}
+		if err := f(key, item); err != nil {
+			return err
+		}
+	}
+}
@@ -1,11 +1,7 @@
 package index
 
 import (
-	"bytes"
-	"encoding/gob"
-	"io"
-	"os"
-	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -19,10 +15,24 @@ type Index interface {
 	Has([]byte) bool
 	Delete([]byte)
 	Keys() []string
-	Encode() ([]byte, error)
-	Sync(string) error
-	Load(io.Reader) error
 	Index() map[string]internal.Item
+	Iterator(reverse bool) Iterator
+}
+
+// Type kind of memory index
+type Type uint8
+
+const (
+	TypeHash     Type = iota // unordered hash map, ordered iteration sorts all keys first
+	TypeSkipList             // ordered skip list, supports prefix and range iteration natively
+)
+
+// New returns memory index of specified type
+func New(t Type) Index {
+	if t == TypeSkipList {
+		return NewSkipList()
+	}
+	return NewKeyDir()
 }
 
 // KeyDir the index in memory
@@ -108,42 +118,16 @@ func (k *KeyDir) Index() map[string]internal.Item {
 	return idx
 }
 
-func (k *KeyDir) Encode() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(k.index)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-// Sync save key-dirs hash index to hint-datafile
-func (k *KeyDir) Sync(path string) (err error) {
-	tmpPath := filepath.Join(path, "index-temp")
-	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	buf, err := k.Encode()
-	if err != nil {
-		return err
-	}
-	if _, err = f.Write(buf); err != nil {
-		return
-	}
-	if err = f.Sync(); err != nil {
-		return
-	}
-	if err = os.Rename(tmpPath, filepath.Join(path, "index")); err != nil {
-		return err
+// Iterator over a sorted copy of keys in key-dir
+func (k *KeyDir) Iterator(reverse bool) Iterator {
+	k.RLock()
+	entries := make([]sliceEntry, 0, len(k.index))
+	for key, item := range k.index {
+		entries = append(entries, sliceEntry{key: key, item: item})
 	}
-	return
-}
-
-// Load key-dirs index from datafile
-func (k *KeyDir) Load(r io.Reader) error {
-	dec := gob.NewDecoder(r)
-	return dec.Decode(&k.index)
+	k.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return &sliceIterator{entries: entries, reverse: reverse}
 }
@@ -1,8 +1,12 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/zach030/tiny-bitcask/internal"
@@ -15,39 +19,103 @@ func TestKeyDir_Write2Hint(t *testing.T) {
 	// hint, _ := os.OpenFile("data/index", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 	kd.Add([]byte("key1"), internal.Item{
 		FileID:    1,
+		Seq:       3,
 		ValueSize: 20,
 		ValuePos:  12,
 		TimeStamp: 1234567,
 	})
 	kd.Add([]byte("key2"), internal.Item{
 		FileID:    2,
+		Seq:       1,
 		ValueSize: 23,
 		ValuePos:  11,
 		TimeStamp: 1234567,
 	})
 	kd.Add([]byte("key3"), internal.Item{
 		FileID:    3,
+		Seq:       4,
 		ValueSize: 54,
 		ValuePos:  17,
 		TimeStamp: 1234567,
 	})
 	kd.Add([]byte("key4"), internal.Item{
 		FileID:    4,
+		Seq:       2,
 		ValueSize: 76,
 		ValuePos:  45,
 		TimeStamp: 1234567,
 	})
-	err := kd.Sync("../data")
+	dir := t.TempDir()
+	hints := make(map[int][]byte)
+	for key, item := range kd.Index() {
+		hints[item.FileID] = append(hints[item.FileID], EncodeHint(key, item)...)
+	}
+	err := WriteHints(dir, hints)
 	assert.Equal(t, err, nil)
 
 	newKd := NewKeyDir()
-	h, _ := os.Open("../data/index")
-	err = newKd.Load(h)
-	if err != nil {
-		t.Error(err)
-		return
+	for fid := 1; fid <= 4; fid++ {
+		h, err := os.Open(filepath.Join(dir, fmt.Sprintf(DefaultHintFileName, fid)))
+		assert.Equal(t, err, nil)
+		stat, err := h.Stat()
+		assert.Equal(t, err, nil)
+		err = ReadHints(h, stat.Size(), fid, func(key []byte, item internal.Item) error {
+			newKd.Add(key, item)
+			return nil
+		})
+		h.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
 	}
+	assert.Equal(t, newKd.Index(), kd.Index())
 	for s, item := range newKd.Index() {
 		fmt.Printf("key:%v, value:%v\n", s, item)
 	}
+
+	// 损坏的key大小超出文件时不分配内存
+	buf := EncodeHint("key1", internal.Item{})
+	binary.LittleEndian.PutUint32(buf[8:12], math.MaxUint32)
+	err = ReadHints(bytes.NewReader(buf), int64(len(buf)), 1, func(key []byte, item internal.Item) error {
+		return nil
+	})
+	assert.Equal(t, err, ErrCorruptHint)
+}
+
+func TestIterator(t *testing.T) {
+	for name, idx := range map[string]Index{"hash": NewKeyDir(), "skiplist": NewSkipList()} {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"b", "d", "a", "c", "e", "f"} {
+				idx.Add([]byte(key), internal.Item{ValueSize: len(key)})
+			}
+			idx.Delete([]byte("f"))
+			idx.Add([]byte("a"), internal.Item{ValueSize: 10})
+
+			var keys []string
+			it := idx.Iterator(false)
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			assert.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+
+			keys = keys[:0]
+			it = idx.Iterator(true)
+			for it.Seek([]byte("cc")); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			assert.Equal(t, []string{"c", "b", "a"}, keys)
+
+			it = idx.Iterator(false)
+			it.Seek([]byte("a"))
+			assert.Equal(t, 10, it.Item().ValueSize)
+			it.Seek([]byte("cc"))
+			assert.Equal(t, []byte("d"), it.Key())
+			it.Seek([]byte("z"))
+			assert.Equal(t, false, it.Valid())
+			it = idx.Iterator(true)
+			it.Seek([]byte("z"))
+			assert.Equal(t, []byte("e"), it.Key())
+		})
+	}
 }
@@ -0,0 +1,67 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+// Iterator cursor over keys of index in order
+type Iterator interface {
+	Rewind()             // move to the first key, the last key in reverse
+	Seek(key []byte)     // move to the first key >= key, the last key <= key in reverse
+	Next()               // move to the next key
+	Valid() bool         // if the cursor points to a key
+	Key() []byte         // key under cursor
+	Item() internal.Item // item under cursor
+}
+
+type sliceEntry struct {
+	key  string
+	item internal.Item
+}
+
+// sliceIterator iterate over sorted entries copied from index
+type sliceIterator struct {
+	entries []sliceEntry
+	reverse bool
+	pos     int
+}
+
+func (it *sliceIterator) Rewind() {
+	it.pos = 0
+	if it.reverse {
+		it.pos = len(it.entries) - 1
+	}
+}
+
+func (it *sliceIterator) Seek(key []byte) {
+	target := utils.Byte2Str(key)
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.entries[i].key >= target
+	})
+	if it.reverse && (it.pos == len(it.entries) || it.entries[it.pos].key != target) {
+		it.pos--
+	}
+}
+
+func (it *sliceIterator) Next() {
+	if it.reverse {
+		it.pos--
+		return
+	}
+	it.pos++
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Key() []byte {
+	return utils.Str2Bytes(it.entries[it.pos].key)
+}
+
+func (it *sliceIterator) Item() internal.Item {
+	return it.entries[it.pos].item
+}
@@ -0,0 +1,221 @@
+package index
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+const (
+	skipListMaxLevel = 18   // enough for 4^18 keys
+	skipListP        = 0.25 // probability of promoting node to upper level
+)
+
+type skipNode struct {
+	key  string
+	item internal.Item
+	next []*skipNode
+	prev *skipNode // backward link on level 0 for reverse iteration
+}
+
+// SkipList the ordered index in memory
+type SkipList struct {
+	sync.RWMutex
+	head   *skipNode
+	tail   *skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+// NewSkipList returns ordered memory index
+func NewSkipList() Index {
+	return &SkipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *SkipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rnd.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual returns the first node whose key >= key,
+// prevs is filled with the last node before it on each level if not nil
+func (s *SkipList) findGreaterOrEqual(key string, prevs []*skipNode) *skipNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prevs != nil {
+			prevs[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// Add idx to memory after write in disk
+func (s *SkipList) Add(key []byte, item internal.Item) {
+	s.Lock()
+	defer s.Unlock()
+	prevs := make([]*skipNode, skipListMaxLevel)
+	keyStr := utils.Byte2Str(key)
+	if x := s.findGreaterOrEqual(keyStr, prevs); x != nil && x.key == keyStr {
+		x.item = item
+		return
+	}
+	level := s.randomLevel()
+	for i := s.level; i < level; i++ {
+		prevs[i] = s.head
+	}
+	if level > s.level {
+		s.level = level
+	}
+	x := &skipNode{key: string(key), item: item, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prevs[i].next[i]
+		prevs[i].next[i] = x
+	}
+	if prevs[0] != s.head {
+		x.prev = prevs[0]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x
+	} else {
+		s.tail = x
+	}
+	s.length++
+}
+
+// Get item in index
+func (s *SkipList) Get(key []byte) (internal.Item, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	keyStr := utils.Byte2Str(key)
+	if x := s.findGreaterOrEqual(keyStr, nil); x != nil && x.key == keyStr {
+		return x.item, true
+	}
+	return internal.Item{}, false
+}
+
+// Has item in index
+func (s *SkipList) Has(key []byte) bool {
+	_, ok := s.Get(key)
+	return ok
+}
+
+// Delete item in index, the removed node keeps its links so that iterators on it can move on
+func (s *SkipList) Delete(key []byte) {
+	s.Lock()
+	defer s.Unlock()
+	prevs := make([]*skipNode, skipListMaxLevel)
+	keyStr := utils.Byte2Str(key)
+	x := s.findGreaterOrEqual(keyStr, prevs)
+	if x == nil || x.key != keyStr {
+		return
+	}
+	for i := 0; i < len(x.next); i++ {
+		prevs[i].next[i] = x.next[i]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x.prev
+	} else {
+		s.tail = x.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+}
+
+// Keys list all keys in index in order
+func (s *SkipList) Keys() []string {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]string, 0, s.length)
+	for x := s.head.next[0]; x != nil; x = x.next[0] {
+		keys = append(keys, x.key)
+	}
+	return keys
+}
+
+// Index map in skip list
+func (s *SkipList) Index() map[string]internal.Item {
+	s.RLock()
+	defer s.RUnlock()
+	idx := make(map[string]internal.Item, s.length)
+	for x := s.head.next[0]; x != nil; x = x.next[0] {
+		idx[x.key] = x.item
+	}
+	return idx
+}
+
+// Iterator over live skip list, keys added or deleted during iteration may or may not be seen
+func (s *SkipList) Iterator(reverse bool) Iterator {
+	return &skipListIterator{list: s, reverse: reverse}
+}
+
+type skipListIterator struct {
+	list    *SkipList
+	node    *skipNode
+	reverse bool
+}
+
+func (it *skipListIterator) Rewind() {
+	it.list.RLock()
+	defer it.list.RUnlock()
+	if it.reverse {
+		it.node = it.list.tail
+		return
+	}
+	it.node = it.list.head.next[0]
+}
+
+func (it *skipListIterator) Seek(key []byte) {
+	it.list.RLock()
+	defer it.list.RUnlock()
+	keyStr := utils.Byte2Str(key)
+	x := it.list.findGreaterOrEqual(keyStr, nil)
+	if it.reverse {
+		switch {
+		case x == nil:
+			x = it.list.tail
+		case x.key != keyStr:
+			x = x.prev
+		}
+	}
+	it.node = x
+}
+
+func (it *skipListIterator) Next() {
+	it.list.RLock()
+	defer it.list.RUnlock()
+	if it.reverse {
+		it.node = it.node.prev
+		return
+	}
+	it.node = it.node.next[0]
+}
+
+func (it *skipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *skipListIterator) Key() []byte {
+	return utils.Str2Bytes(it.node.key)
+}
+
+func (it *skipListIterator) Item() internal.Item {
+	it.list.RLock()
+	defer it.list.RUnlock()
+	return it.node.item
+}
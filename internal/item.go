@@ -2,8 +2,15 @@ package internal
 
 // Item is the index in memory
 type Item struct {
-	FileID    int   // specify which datafile
-	ValueSize int   // size of value
-	ValuePos  int64 // pos of value for seek
-	TimeStamp int64 // timestamp
+	FileID    int    // specify which datafile
+	ValueSize int    // size of value
+	ValuePos  int64  // pos of value for seek
+	TimeStamp int64  // timestamp
+	ExpiredAt int64  // expire timestamp in unix nano, 0 means never expire
+	Seq       uint64 // db-wide monotonic sequence number of the write, newer record has larger seq
+}
+
+// IsExpired if the item is expired at now (unix nano)
+func (i Item) IsExpired(now int64) bool {
+	return i.ExpiredAt > 0 && i.ExpiredAt <= now
 }
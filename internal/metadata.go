@@ -1,5 +1,105 @@
 package internal
 
+// FileStat 单个数据文件中有效与无效记录的字节数
+type FileStat struct {
+	Live   int64  `json:"live"`    // 仍被索引引用或必须保留的记录字节数
+	Dead   int64  `json:"dead"`    // 被覆盖、删除或过期的记录字节数
+	MinSeq uint64 `json:"min_seq"` // 文件中最小的记录序号，判断合并时能否丢弃删除记录
+}
+
+// Size 已统计的字节数，与文件大小一致时统计才完整
+func (s *FileStat) Size() int64 {
+	return s.Live + s.Dead
+}
+
+// GarbageRatio 无效字节占文件的比例
+func (s *FileStat) GarbageRatio() float64 {
+	if s.Size() == 0 {
+		return 0
+	}
+	return float64(s.Dead) / float64(s.Size())
+}
+
+// Reclaimable 无效字节比例不低于ratio，需要合并
+func (s *FileStat) Reclaimable(ratio float64) bool {
+	return s.Dead > 0 && s.GarbageRatio() >= ratio
+}
+
+// MetaData 每个数据文件的字节统计，用于挑选需要合并的文件
 type MetaData struct {
-	ReclaimSpace int64 // 需要回收的空间大小（重复的key）
+	ReclaimSpace int64             `json:"-"`     // 所有文件的无效字节数之和
+	Files        map[int]*FileStat `json:"files"` // 数据文件id及其统计
+}
+
+// NewMetaData returns empty stats
+func NewMetaData() *MetaData {
+	return &MetaData{Files: make(map[int]*FileStat)}
+}
+
+// Stat 返回文件的统计，不存在时创建
+func (m *MetaData) Stat(fid int) *FileStat {
+	s, ok := m.Files[fid]
+	if !ok {
+		s = &FileStat{}
+		m.Files[fid] = s
+	}
+	return s
+}
+
+// Append 统计新写入的记录，live为false表示记录写入时就是无效的，如删除记录、批量提交标记
+func (m *MetaData) Append(fid int, size int64, seq uint64, live bool) {
+	s := m.Stat(fid)
+	if seq > 0 && (s.MinSeq == 0 || seq < s.MinSeq) {
+		s.MinSeq = seq
+	}
+	if live {
+		s.Live += size
+		return
+	}
+	s.Dead += size
+	m.ReclaimSpace += size
+}
+
+// Discard 记录被覆盖、删除或过期，由有效转为无效
+func (m *MetaData) Discard(fid int, size int64) {
+	s := m.Stat(fid)
+	s.Live -= size
+	s.Dead += size
+	m.ReclaimSpace += size
+}
+
+// Fill 文件中未统计到的字节（未提交的批量记录、写入失败残留的数据）计为无效
+func (m *MetaData) Fill(fid int, size int64) {
+	s := m.Stat(fid)
+	if n := size - s.Size(); n > 0 {
+		s.Dead += n
+		m.ReclaimSpace += n
+	}
+}
+
+// Remove 删除文件的统计
+func (m *MetaData) Remove(fid int) {
+	if s, ok := m.Files[fid]; ok {
+		m.ReclaimSpace -= s.Dead
+		delete(m.Files, fid)
+	}
+}
+
+// Reclaimable 无效字节比例不低于ratio的文件中可回收的字节数
+func (m *MetaData) Reclaimable(ratio float64) int64 {
+	var n int64
+	for _, s := range m.Files {
+		if s.Reclaimable(ratio) {
+			n += s.Dead
+		}
+	}
+	return n
+}
+
+// Reset 重新计算无效字节之和，从文件加载统计后调用
+func (m *MetaData) Reset() {
+	m.ReclaimSpace = 0
+	for _, s := range m.Files {
+		m.ReclaimSpace += s.Dead
+	}
 }
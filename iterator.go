@@ -0,0 +1,216 @@
+package bitcask
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/internal/index"
+)
+
+// IteratorOptions options of iterator
+type IteratorOptions struct {
+	Reverse      bool   // iterate keys in descending order
+	Prefix       []byte // only keys with the prefix are iterated
+	KeyOnly      bool   // values are never read, Value returns ErrKeyOnlyIterator
+	PrefetchSize int    // values of the next n keys are read ahead in one batch, 0 reads value on demand
+}
+
+// Iterator cursor over keys in order, expired keys are skipped. Values are read from
+// datafile only when requested, so a key rewritten during iteration yields its latest value.
+// With OrderedIndex keys are streamed from index, with HashIndex they are sorted on creation.
+type Iterator struct {
+	db     *BitCask
+	it     index.Iterator
+	opts   IteratorOptions
+	now    int64
+	window []iterEntry // 当前窗口内的key，预读时同时带有value
+	pos    int
+}
+
+// iterEntry key in iterator window
+type iterEntry struct {
+	key   []byte
+	item  internal.Item
+	value []byte
+	err   error
+	read  bool // value has been read
+}
+
+// NewIterator returns an iterator positioned at the first key, call Close after use.
+func (b *BitCask) NewIterator(opts IteratorOptions) *Iterator {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.newIterator(opts)
+}
+
+// newIterator 创建迭代器，调用方需持有读锁
+func (b *BitCask) newIterator(opts IteratorOptions) *Iterator {
+	iter := &Iterator{
+		db:   b,
+		it:   b.indexer.Iterator(opts.Reverse),
+		opts: opts,
+		now:  time.Now().UnixNano(),
+	}
+	iter.Rewind()
+	return iter
+}
+
+// Rewind move to the first key, the last key in reverse
+func (it *Iterator) Rewind() {
+	switch {
+	case len(it.opts.Prefix) == 0:
+		it.it.Rewind()
+	case !it.opts.Reverse:
+		it.it.Seek(it.opts.Prefix)
+	default:
+		// 逆序时定位到前缀的后继之前的最后一个key
+		end := prefixEnd(it.opts.Prefix)
+		if end == nil {
+			it.it.Rewind()
+			break
+		}
+		it.it.Seek(end)
+		if it.it.Valid() && bytes.Equal(it.it.Key(), end) {
+			it.it.Next()
+		}
+	}
+	it.fill()
+}
+
+// Seek move to the first key >= key, the last key <= key in reverse. With Prefix a key before
+// the keys with the prefix (after them in reverse) moves to the first one.
+func (it *Iterator) Seek(key []byte) {
+	if len(it.opts.Prefix) > 0 {
+		if !it.opts.Reverse && bytes.Compare(key, it.opts.Prefix) < 0 {
+			it.Rewind()
+			return
+		}
+		// 逆序时超出前缀范围的key定位到前缀的最后一个key
+		if end := prefixEnd(it.opts.Prefix); it.opts.Reverse && end != nil && bytes.Compare(key, end) >= 0 {
+			it.Rewind()
+			return
+		}
+	}
+	it.it.Seek(key)
+	it.fill()
+}
+
+// Next move to the next key
+func (it *Iterator) Next() {
+	if it.pos++; it.pos >= len(it.window) {
+		it.fill()
+	}
+}
+
+// Valid if the iterator points to a key
+func (it *Iterator) Valid() bool {
+	return it.pos < len(it.window)
+}
+
+// Key under the iterator, it must not be modified
+func (it *Iterator) Key() []byte {
+	return it.window[it.pos].key
+}
+
+// Value under the iterator, read from datafile unless it was prefetched
+func (it *Iterator) Value() ([]byte, error) {
+	if it.opts.KeyOnly {
+		return nil, ErrKeyOnlyIterator
+	}
+	e := &it.window[it.pos]
+	if !e.read {
+		it.db.lock.RLock()
+		e.value, e.err = it.db.readKey(e.key)
+		it.db.lock.RUnlock()
+		e.read = true
+	}
+	return e.value, e.err
+}
+
+// Close release the iterator
+func (it *Iterator) Close() {
+	it.it = nil
+	it.window = nil
+	it.pos = 0
+}
+
+// fill 从索引中取出下一批未过期且匹配前缀的key，开启预读时一并读取value
+func (it *Iterator) fill() {
+	size := it.opts.PrefetchSize
+	if size <= 0 || it.opts.KeyOnly {
+		size = 1
+	}
+	it.window = it.window[:0]
+	it.pos = 0
+	for ; it.it.Valid() && len(it.window) < size; it.it.Next() {
+		key := it.it.Key()
+		// 有序遍历时前缀不匹配后不会再有匹配的key
+		if !bytes.HasPrefix(key, it.opts.Prefix) {
+			break
+		}
+		item := it.it.Item()
+		if item.IsExpired(it.now) {
+			continue
+		}
+		it.window = append(it.window, iterEntry{key: key, item: item})
+	}
+	if it.opts.PrefetchSize <= 0 || it.opts.KeyOnly || len(it.window) == 0 {
+		return
+	}
+	it.db.lock.RLock()
+	defer it.db.lock.RUnlock()
+	for i := range it.window {
+		e := &it.window[i]
+		e.value, e.err = it.db.readKey(e.key)
+		e.read = true
+	}
+}
+
+// readKey 读取key当前的value，迭代期间key可能被重写或合并，需要重新查询索引，调用方需持有读锁
+func (b *BitCask) readKey(key []byte) ([]byte, error) {
+	item, ok := b.lookup(key)
+	if !ok {
+		return nil, ErrSpecifyKeyNotExist
+	}
+	return b.read(item)
+}
+
+// Scan iterate over keys with prefix in ascending order.
+func (b *BitCask) Scan(prefix []byte, f func(key []byte) error) error {
+	it := b.NewIterator(IteratorOptions{Prefix: prefix, KeyOnly: true})
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if err := f(it.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range iterate over keys in [start, end) in ascending order, nil end means no upper bound.
+func (b *BitCask) Range(start, end []byte, f func(key []byte) error) error {
+	it := b.NewIterator(IteratorOptions{KeyOnly: true})
+	defer it.Close()
+	for it.Seek(start); it.Valid(); it.Next() {
+		if end != nil && bytes.Compare(it.Key(), end) >= 0 {
+			return nil
+		}
+		if err := f(it.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixEnd the smallest key greater than all keys with the prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,473 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	df "github.com/zach030/tiny-bitcask/internal/datafile"
+	idx "github.com/zach030/tiny-bitcask/internal/index"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+// 合并清单记录的切换阶段
+const (
+	mergePhaseRemove = "remove" // 正在删除被合并的旧文件
+	mergePhaseMove   = "move"   // 旧文件已删除，正在移入合并后的文件
+)
+
+// mergeManifest 合并清单，合并结果完整落盘后写入，存在清单说明合并结果可以直接使用
+type mergeManifest struct {
+	Merged []int    `json:"merged"` // 参与合并的文件id，这些旧文件都被合并结果替代
+	Phase  string   `json:"phase"`  // 切换阶段
+	Files  []string `json:"files"`  // 合并产生的数据文件与hint文件，复用参与合并的文件id
+}
+
+// merger 一次合并扫描过程中的状态
+type merger struct {
+	db         *BitCask       // 写入合并结果的临时db
+	maxFiles   int            // 合并结果最多占用的文件数，即被合并的文件数
+	minSeq     uint64         // 未参与合并的文件中最小的记录序号
+	tombstones map[int][]byte // 合并保留下来的删除记录，按临时db中的文件id编码为hint
+	limiter    *rateLimiter   // 限制合并读写的速率
+	progress   *MergeProgress
+}
+
+// mergeResult 合并产生的索引与文件统计，文件id已换成复用的被合并文件id
+type mergeResult struct {
+	fids  []int                    // 参与合并的文件id
+	index map[string]internal.Item // 合并后的索引
+	stats map[int]*internal.FileStat
+}
+
+// MergeProgress progress of a merge, reported after each data file is processed and once more
+// when the merge finishes
+type MergeProgress struct {
+	FilesTotal     int   // count of data files to merge
+	FilesProcessed int   // count of data files processed
+	KeysRewritten  int64 // count of live keys rewritten to merged files
+	BytesReclaimed int64 // size of stale records dropped
+	Done           bool  // the merge finished, Err is set if it failed
+	Err            error // error of the finished merge
+}
+
+// Merge Compact the immutable data files and produce hint files, it returns once the merge
+// completes or ctx is canceled. Progress is reported to the callback set by WithMergeProgress.
+func (b *BitCask) Merge(ctx context.Context) error {
+	return b.merge(ctx)
+}
+
+// merge Merge several data files within a Bitcask datastore into a more compact form.
+// Also, produce hintfiles for faster startup.
+// 合并期间读写不受影响：新的写入进入新的活跃文件，读取继续使用旧文件；
+// 合并结果完整落盘后写入合并清单，再在写锁内切换文件并替换仍指向旧位置的索引，
+// 任何时刻宕机，重新打开时都可以根据清单完成或丢弃本次合并
+func (b *BitCask) merge(ctx context.Context) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if !atomic.CompareAndSwapInt32(&b.merging, 0, 1) {
+		return ErrMergeInProgress
+	}
+	defer atomic.StoreInt32(&b.merging, 0)
+	b.mergeLock.Lock()
+	defer b.mergeLock.Unlock()
+	if atomic.LoadInt32(&b.closed) == 1 {
+		return ErrDatabaseClosed
+	}
+	progress := &MergeProgress{}
+	err := b.doMerge(ctx, progress)
+	atomic.StoreInt64(&b.lastMerge, time.Now().UnixNano())
+	progress.Done = true
+	progress.Err = err
+	b.reportMerge(*progress)
+	return err
+}
+
+func (b *BitCask) doMerge(ctx context.Context, progress *MergeProgress) error {
+	files, minSeq, err := b.prepareMerge()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	progress.FilesTotal = len(files)
+	mergePath := filepath.Join(b.path, MergeTmpFolder)
+	res, err := b.newTmpMergeDB(ctx, mergePath, files, minSeq, progress)
+	// 清单写入前失败或被取消，合并结果不完整，直接丢弃
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.RemoveAll(mergePath)
+		return err
+	}
+	return b.commitMerge(mergePath, res)
+}
+
+// reportMerge 将合并进度交给回调
+func (b *BitCask) reportMerge(progress MergeProgress) {
+	if b.config.MergeProgress != nil {
+		b.config.MergeProgress(progress)
+	}
+}
+
+// commitMerge 写入合并清单后切换到合并后的文件
+func (b *BitCask) commitMerge(mergePath string, res *mergeResult) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// 合并期间创建的快照可能引用了被合并的文件
+	for _, fid := range res.fids {
+		if b.pins[fid] > 0 {
+			os.RemoveAll(mergePath)
+			return ErrSnapshotActive
+		}
+	}
+	m, err := newMergeManifest(mergePath, res.fids)
+	if err != nil {
+		os.RemoveAll(mergePath)
+		return err
+	}
+	if err = writeMergeManifest(mergePath, m); err != nil {
+		os.RemoveAll(mergePath)
+		return err
+	}
+	// 将旧的文件删除,将合并后的文件，改到当前db文件夹下
+	if err = b.switchMerge(mergePath, m); err != nil {
+		return err
+	}
+	if err = b.reopenMerged(m); err != nil {
+		return err
+	}
+	for _, fid := range res.fids {
+		b.metadata.Remove(fid)
+	}
+	for fid, stat := range res.stats {
+		b.metadata.Files[fid] = stat
+	}
+	b.metadata.Reset()
+	b.swapIndex(res)
+	// 合并时被丢弃的删除记录可能持有最大的序号，需要与新的文件统计一起保存
+	return b.saveMeta(false)
+}
+
+// reopenMerged 关闭被合并的旧文件，打开合并后的数据文件，调用方需持有写锁
+func (b *BitCask) reopenMerged(m *mergeManifest) error {
+	for _, fid := range m.Merged {
+		f, ok := b.dataFiles[fid]
+		if !ok {
+			continue
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		delete(b.dataFiles, fid)
+	}
+	for _, name := range m.Files {
+		fid, _ := utils.ParseFileID(name)
+		if filepath.Ext(name) != DataFileExt {
+			continue
+		}
+		f, err := df.NewBkFile(b.path, fid, false)
+		if err != nil {
+			return err
+		}
+		b.dataFiles[fid] = f
+	}
+	return nil
+}
+
+// swapIndex 逐个检查合并结果中的key，索引仍指向被合并的文件且序号未变说明合并期间没有被重写，
+// 替换为合并后的位置；合并期间被重写的key在合并后的文件中计为无效。索引仍指向被合并的文件却没有
+// 合并结果的key已经过期，记录随旧文件一起删除，直接从索引中删除，不能留给过期清理计入复用了id的新文件。
+// 调用方需持有写锁
+func (b *BitCask) swapIndex(res *mergeResult) {
+	merged := make(map[int]bool, len(res.fids))
+	for _, fid := range res.fids {
+		merged[fid] = true
+	}
+	// 合并后的文件复用旧id，需要在替换位置之前找出
+	var dropped []string
+	for key, item := range b.indexer.Index() {
+		if _, ok := res.index[key]; !ok && merged[item.FileID] {
+			dropped = append(dropped, key)
+		}
+	}
+	for key, item := range res.index {
+		kb := utils.Str2Bytes(key)
+		if cur, ok := b.indexer.Get(kb); ok && merged[cur.FileID] && cur.Seq == item.Seq {
+			b.indexer.Add(kb, item)
+			continue
+		}
+		b.metadata.Discard(item.FileID, int64(item.ValueSize))
+	}
+	for _, key := range dropped {
+		b.indexer.Delete(utils.Str2Bytes(key))
+	}
+}
+
+// prepareMerge 挑选无效字节比例达到合并比例的数据文件，被快照引用的文件跳过，活跃文件被选中时先关闭并创建新的活跃文件；
+// 返回按id排序的待合并文件，以及未参与合并的文件中最小的记录序号
+func (b *BitCask) prepareMerge() ([]df.DataFile, uint64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	reclaimable := func(fid int) bool {
+		stat, ok := b.metadata.Files[fid]
+		return ok && b.pins[fid] == 0 && stat.Reclaimable(b.config.MergePolicy.MinGarbageRatio)
+	}
+	if reclaimable(b.curr.FileID()) {
+		// 将当前活跃文件关闭，创建一个新的file用于写操作
+		if err := b.closeActiveFile(); err != nil {
+			return nil, 0, err
+		}
+		if err := b.newActiveFile(); err != nil {
+			return nil, 0, err
+		}
+	}
+	// 整理所有待合并的文件列表
+	var mergeFiles []int
+	minSeq := uint64(math.MaxUint64)
+	for fid := range b.dataFiles {
+		if reclaimable(fid) {
+			mergeFiles = append(mergeFiles, fid)
+		} else if stat, ok := b.metadata.Files[fid]; ok && stat.MinSeq > 0 && stat.MinSeq < minSeq {
+			minSeq = stat.MinSeq
+		}
+	}
+	sort.Ints(mergeFiles)
+	files := make([]df.DataFile, len(mergeFiles))
+	for i, fid := range mergeFiles {
+		files[i] = b.dataFiles[fid]
+	}
+	return files, minSeq, nil
+}
+
+// newTmpMergeDB 依次扫描待合并的文件，将仍然有效的记录写入临时目录，关闭时数据文件落盘。
+// 合并后的文件依次复用被合并文件的id，并为每个文件生成hint文件。扫描只读取不可变的旧文件，不阻塞读写。
+// 临时db只由合并协程写入，不启动后台协程，也不清理过期key，写入时仍持有它的写锁
+func (b *BitCask) newTmpMergeDB(ctx context.Context, mergePath string, files []df.DataFile, minSeq uint64, progress *MergeProgress) (*mergeResult, error) {
+	// 清理上次残留的合并目录
+	if err := os.RemoveAll(mergePath); err != nil {
+		return nil, err
+	}
+	mergeDB, err := open(mergePath, WithConfig(b.config), WithSweepInterval(0))
+	if err != nil {
+		return nil, err
+	}
+	res := &mergeResult{stats: make(map[int]*internal.FileStat)}
+	for _, f := range files {
+		res.fids = append(res.fids, f.FileID())
+	}
+	m := &merger{
+		db:         mergeDB,
+		maxFiles:   len(files),
+		minSeq:     minSeq,
+		tombstones: make(map[int][]byte),
+		limiter:    newRateLimiter(b.config.MergePolicy.RateLimit),
+		progress:   progress,
+	}
+	for _, f := range files {
+		if err = b.mergeFile(ctx, m, f); err != nil {
+			mergeDB.Close()
+			return nil, err
+		}
+		progress.FilesProcessed++
+		b.reportMerge(*progress)
+	}
+	mergeDB.lock.RLock()
+	index := mergeDB.indexer.Index()
+	stats := mergeDB.metadata.Files
+	mergeDB.lock.RUnlock()
+	if err = mergeDB.Close(); err != nil {
+		return nil, err
+	}
+	// 合并db的文件id从0开始连续分配，从后往前重命名，避免覆盖尚未重命名的文件
+	for fid := len(files) - 1; fid >= 0; fid-- {
+		stat, ok := stats[fid]
+		if !ok || stat.Size() == 0 {
+			os.Remove(filepath.Join(mergePath, fmt.Sprintf(df.DefaultBkFileName, fid)))
+			continue
+		}
+		if err = os.Rename(filepath.Join(mergePath, fmt.Sprintf(df.DefaultBkFileName, fid)),
+			filepath.Join(mergePath, fmt.Sprintf(df.DefaultBkFileName, res.fids[fid]))); err != nil {
+			return nil, err
+		}
+		res.stats[res.fids[fid]] = stat
+	}
+	res.index = make(map[string]internal.Item, len(index))
+	hints := make(map[int][]byte)
+	for fid, buf := range m.tombstones {
+		hints[res.fids[fid]] = buf
+	}
+	for key, item := range index {
+		item.FileID = res.fids[item.FileID]
+		res.index[key] = item
+		hints[item.FileID] = append(hints[item.FileID], idx.EncodeHint(key, item)...)
+	}
+	// 为合并后的每个数据文件生成hint文件，加快启动
+	if err = idx.WriteHints(mergePath, hints); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// mergeFile 将文件中仍然有效的记录写入合并db，被覆盖、删除或过期的记录丢弃。
+// 未参与合并的文件可能持有更早的记录，序号大于minSeq的删除记录与过期记录需要以删除记录保留下来，
+// 防止重新打开时旧记录复活
+func (b *BitCask) mergeFile(ctx context.Context, m *merger, f df.DataFile) error {
+	mergeDB, progress := m.db, m.progress
+	err := f.Scan(0, func(e *internal.Entry, offset int64, size int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// 读取的字节计入速率限制
+		if err := m.limiter.wait(ctx, size); err != nil {
+			return err
+		}
+		if !e.IsValid() {
+			return &ErrCorruptEntry{FileID: f.FileID(), Offset: offset, Err: ErrInvalidCheckSum}
+		}
+		b.lock.RLock()
+		item, ok := b.indexer.Get(e.Key())
+		b.lock.RUnlock()
+		key := append([]byte(nil), e.Key()...)
+		here := ok && item.FileID == f.FileID() && item.ValuePos == offset
+		expired := e.ExpiredAt() > 0 && e.ExpiredAt() <= time.Now().UnixNano()
+		mergeDB.lock.Lock()
+		defer mergeDB.lock.Unlock()
+		// 合并结果复用被合并文件的id，文件数达到上限后不再切分
+		if mergeDB.curr.FileID() >= m.maxFiles-1 {
+			mergeDB.config.MaxFileSize = math.MaxInt64
+		}
+		switch op := e.Mode().Op(); {
+		case op == internal.ModePut && here && !expired:
+			// 索引指向的位置就是此记录时才是最新的有效记录
+			progress.KeysRewritten++
+			// 沿用原记录的序号，保证合并前后记录的先后顺序不变，也用于切换时判断key是否被重写
+			if err := mergeDB.setEntry(mergeDB.newEntry(key, e.Value(), internal.ModePut, e.Seq(), e.ExpiredAt())); err != nil {
+				return err
+			}
+			return m.limiter.wait(ctx, size)
+		case e.Seq() > m.minSeq && (op == internal.ModeDelete && !ok || op == internal.ModePut && expired && (!ok || here)):
+			tomb := mergeDB.newEntry(key, nil, internal.ModeDelete, e.Seq(), 0)
+			pos, n, err := mergeDB.put(tomb)
+			if err != nil {
+				return err
+			}
+			fid := mergeDB.curr.FileID()
+			mergeDB.metadata.Append(fid, int64(n), tomb.Seq(), true)
+			m.tombstones[fid] = append(m.tombstones[fid], idx.EncodeTombstone(key, pos, tomb.Seq())...)
+			progress.BytesReclaimed += int64(size - n)
+			return m.limiter.wait(ctx, n)
+		default:
+			progress.BytesReclaimed += int64(size)
+		}
+		return nil
+	})
+	return scanError(f.FileID(), err)
+}
+
+// recoverMerge 处理上次中断的合并：没有清单说明合并结果不完整，丢弃合并目录；
+// 有清单说明合并结果已完整落盘，按清单记录的阶段继续完成切换
+func (b *BitCask) recoverMerge() error {
+	mergePath := filepath.Join(b.path, MergeTmpFolder)
+	if !utils.Exist(mergePath) {
+		return nil
+	}
+	m, err := readMergeManifest(mergePath)
+	switch {
+	case os.IsNotExist(err) && b.config.ReadOnly:
+		return nil
+	case os.IsNotExist(err):
+		return os.RemoveAll(mergePath)
+	case err != nil:
+		return err
+	case b.config.ReadOnly:
+		// 只读模式不能修改目录，目录处于合并切换的中间状态
+		return ErrMergeInterrupted
+	}
+	return b.switchMerge(mergePath, m)
+}
+
+// switchMerge 删除被合并的旧文件，再将合并后的文件移入数据目录，每个阶段完成后更新清单，
+// 重复执行是安全的
+func (b *BitCask) switchMerge(mergePath string, m *mergeManifest) error {
+	if m.Phase == mergePhaseRemove {
+		if err := removeMergedFiles(b.path, m.Merged); err != nil {
+			return err
+		}
+		m.Phase = mergePhaseMove
+		if err := writeMergeManifest(mergePath, m); err != nil {
+			return err
+		}
+	}
+	for _, name := range m.Files {
+		src := filepath.Join(mergePath, name)
+		// 已经移入的文件跳过
+		if !utils.Exist(src) {
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(b.path, name)); err != nil {
+			return err
+		}
+	}
+	if err := utils.SyncDir(b.path); err != nil {
+		return err
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// removeMergedFiles 删除参与合并的数据文件与hint文件，删除落盘后才能移入合并后的文件
+func removeMergedFiles(path string, fids []int) error {
+	for _, fid := range fids {
+		for _, fp := range []string{filepath.Join(path, fmt.Sprintf(df.DefaultBkFileName, fid)), hintPath(path, fid)} {
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return utils.SyncDir(path)
+}
+
+// newMergeManifest 列出合并目录中产生的数据文件与hint文件
+func newMergeManifest(mergePath string, fids []int) (*mergeManifest, error) {
+	fs, err := ioutil.ReadDir(mergePath)
+	if err != nil {
+		return nil, err
+	}
+	m := &mergeManifest{Merged: fids, Phase: mergePhaseRemove}
+	for _, f := range fs {
+		if _, ok := utils.ParseFileID(f.Name()); ok && !f.IsDir() {
+			m.Files = append(m.Files, f.Name())
+		}
+	}
+	return m, nil
+}
+
+// writeMergeManifest 将清单写入临时文件后重命名，保证清单完整
+func writeMergeManifest(mergePath string, m *mergeManifest) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(mergePath, MergeManifest), buf, 0600)
+}
+
+// readMergeManifest 读取合并清单，清单不存在时返回os.ErrNotExist
+func readMergeManifest(mergePath string) (*mergeManifest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(mergePath, MergeManifest))
+	if err != nil {
+		return nil, err
+	}
+	m := &mergeManifest{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return nil, ErrInvalidMergeManifest
+	}
+	return m, nil
+}
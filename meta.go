@@ -0,0 +1,192 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+// FormatVersion version of the on-disk format, bumped on incompatible changes of datafile or hint file.
+// Databases of the original format have no meta file, they are rewritten on the first writable open.
+const FormatVersion = 1
+
+// dbMeta 持久化的数据库元数据，打开时写入并标记为未正常关闭，正常关闭时再次写入
+type dbMeta struct {
+	Version int                `json:"version"` // 数据格式版本
+	Config  metaConfig         `json:"config"`  // 创建数据库时的配置，之后放宽的限制会被记录下来
+	Stats   *internal.MetaData `json:"stats"`   // 每个数据文件的有效与无效字节数
+	Seq     uint64             `json:"seq"`     // 最大写入序号
+	Clean   bool               `json:"clean"`   // 上次是否正常关闭，否则文件统计需要在加载索引时重新计算
+}
+
+// metaConfig 创建数据库时的配置，key与value的大小限制决定已写入的数据能否被读写
+type metaConfig struct {
+	MaxFileSize  int64     `json:"max_file_size"`
+	MaxKeySize   uint32    `json:"max_key_size"`
+	MaxValueSize uint64    `json:"max_value_size"`
+	IndexType    IndexType `json:"index_type"`
+}
+
+// newMetaConfig 记录配置中需要持久化的部分
+func newMetaConfig(cfg *Config) metaConfig {
+	return metaConfig{
+		MaxFileSize:  cfg.MaxFileSize,
+		MaxKeySize:   cfg.MaxKeySize,
+		MaxValueSize: cfg.MaxValueSize,
+		IndexType:    cfg.IndexType,
+	}
+}
+
+// check 检查新的配置能否打开已有数据：key与value的大小限制不能比曾经使用过的更严格，0表示不限制
+func (c metaConfig) check(cfg *Config) error {
+	if tighter(uint64(cfg.MaxKeySize), uint64(c.MaxKeySize)) {
+		return &ErrIncompatibleConfig{Option: "MaxKeySize", Stored: uint64(c.MaxKeySize), Given: uint64(cfg.MaxKeySize)}
+	}
+	if tighter(cfg.MaxValueSize, c.MaxValueSize) {
+		return &ErrIncompatibleConfig{Option: "MaxValueSize", Stored: c.MaxValueSize, Given: cfg.MaxValueSize}
+	}
+	return nil
+}
+
+// merge 记录放宽后的限制，此后写入的数据可能依赖它
+func (c *metaConfig) merge(cfg *Config) {
+	if tighter(uint64(c.MaxKeySize), uint64(cfg.MaxKeySize)) {
+		c.MaxKeySize = cfg.MaxKeySize
+	}
+	if tighter(c.MaxValueSize, cfg.MaxValueSize) {
+		c.MaxValueSize = cfg.MaxValueSize
+	}
+	c.MaxFileSize = cfg.MaxFileSize
+	c.IndexType = cfg.IndexType
+}
+
+// tighter 大小限制given是否比stored更严格，0表示不限制
+func tighter(given, stored uint64) bool {
+	return given > 0 && (stored == 0 || given < stored)
+}
+
+// loadMeta 读取元数据文件并检查格式版本与配置；元数据文件不存在时从旧版本的序号文件迁移，
+// 最初版本的数据库先重写为当前格式
+func (b *BitCask) loadMeta() error {
+	buf, err := ioutil.ReadFile(filepath.Join(b.path, MetaFile))
+	if os.IsNotExist(err) {
+		v0, err := isV0(b.path)
+		if err != nil {
+			return err
+		}
+		if v0 {
+			// 只读模式不能重写数据文件
+			if b.config.ReadOnly {
+				return ErrUpgradeRequired
+			}
+			if err = b.upgradeV0(); err != nil {
+				return err
+			}
+			return b.loadMeta()
+		}
+		b.meta = &dbMeta{Version: FormatVersion, Config: newMetaConfig(b.config)}
+		return b.loadSeq()
+	}
+	if err != nil {
+		return err
+	}
+	m := &dbMeta{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return ErrInvalidMetaFile
+	}
+	if m.Version > FormatVersion {
+		return ErrIncompatibleVersion
+	}
+	if err = m.Config.check(b.config); err != nil {
+		return err
+	}
+	b.meta = m
+	b.seq = m.Seq
+	return nil
+}
+
+// LoadConfig returns DefaultConfig with the limits, max file size and index type recorded in meta
+// file of the database at path, so tools can open a database without knowing how it was created.
+// DefaultConfig is returned if the database has no meta file.
+func LoadConfig(path string) (*Config, error) {
+	cfg := *DefaultConfig
+	buf, err := ioutil.ReadFile(filepath.Join(path, MetaFile))
+	if os.IsNotExist(err) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &dbMeta{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return nil, ErrInvalidMetaFile
+	}
+	cfg.MaxFileSize = m.Config.MaxFileSize
+	cfg.MaxKeySize = m.Config.MaxKeySize
+	cfg.MaxValueSize = m.Config.MaxValueSize
+	cfg.IndexType = m.Config.IndexType
+	return &cfg, nil
+}
+
+// loadSeq 读取旧版本持久化的最大序号，重放数据文件时会继续取更大的值
+func (b *BitCask) loadSeq() error {
+	buf, err := ioutil.ReadFile(filepath.Join(b.path, SeqFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 8 {
+		return ErrInvalidSeqFile
+	}
+	b.seq = binary.LittleEndian.Uint64(buf)
+	return nil
+}
+
+// cleanStats 上次正常关闭时保存的文件统计，替换加载索引时重新得到的统计；
+// 统计与数据文件对不上时说明目录被修改过，沿用重新统计的结果
+func (b *BitCask) cleanStats() {
+	saved := b.meta.Stats
+	if !b.meta.Clean || saved == nil || saved.Files == nil {
+		return
+	}
+	for fid, f := range b.dataFiles {
+		if saved.Stat(fid).Size() != f.Size() {
+			return
+		}
+	}
+	for fid := range saved.Files {
+		if _, ok := b.dataFiles[fid]; !ok {
+			delete(saved.Files, fid)
+		}
+	}
+	saved.Reset()
+	b.metadata = saved
+}
+
+// saveMeta 写入元数据，clean表示正常关闭；写入临时文件后重命名，保证元数据文件完整，
+// 元数据落盘后删除旧版本的序号文件
+func (b *BitCask) saveMeta(clean bool) error {
+	b.meta.Version = FormatVersion
+	b.meta.Config.merge(b.config)
+	b.meta.Stats = b.metadata
+	b.meta.Seq = b.seq
+	b.meta.Clean = clean
+	buf, err := json.Marshal(b.meta)
+	if err != nil {
+		return err
+	}
+	if err = utils.WriteFileAtomic(filepath.Join(b.path, MetaFile), buf, 0600); err != nil {
+		return err
+	}
+	if err = os.Remove(filepath.Join(b.path, SeqFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
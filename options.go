@@ -1,5 +1,7 @@
 package bitcask
 
+import "time"
+
 type Option func(config *Config) error
 
 func WithConfig(src *Config) Option {
@@ -7,7 +9,13 @@ func WithConfig(src *Config) Option {
 		config.MaxFileSize = src.MaxFileSize
 		config.MaxKeySize = src.MaxKeySize
 		config.MaxValueSize = src.MaxValueSize
-		config.Sync = src.Sync
+		config.SyncMode = src.SyncMode
+		config.SyncInterval = src.SyncInterval
+		config.GroupCommitWait = src.GroupCommitWait
+		config.SweepInterval = src.SweepInterval
+		config.IndexType = src.IndexType
+		config.Checksum = src.Checksum
+		config.MergePolicy = src.MergePolicy
 		return nil
 	}
 }
@@ -18,3 +26,130 @@ func WithMaxFileSize(size int64) Option {
 		return nil
 	}
 }
+
+// WithMergeRatio merge only the datafiles whose ratio of stale bytes reaches ratio, in (0, 1]
+func WithMergeRatio(ratio float64) Option {
+	return func(config *Config) error {
+		if ratio <= 0 || ratio > 1 {
+			return ErrInvalidMergeRatio
+		}
+		config.MergePolicy.MinGarbageRatio = ratio
+		return nil
+	}
+}
+
+// WithMergePolicy set thresholds, time windows, cooldown and rate limit of merge
+func WithMergePolicy(policy MergePolicy) Option {
+	return func(config *Config) error {
+		if !policy.valid() {
+			return ErrInvalidMergePolicy
+		}
+		config.MergePolicy = policy
+		return nil
+	}
+}
+
+// WithMaxKeySize limit size of keys, 0 means unlimited. It can't be stricter than the limit
+// existing data was written with.
+func WithMaxKeySize(size uint32) Option {
+	return func(config *Config) error {
+		config.MaxKeySize = size
+		return nil
+	}
+}
+
+// WithMaxValueSize limit size of values, 0 means unlimited. It can't be stricter than the limit
+// existing data was written with.
+func WithMaxValueSize(size uint64) Option {
+	return func(config *Config) error {
+		config.MaxValueSize = size
+		return nil
+	}
+}
+
+func WithSweepInterval(interval time.Duration) Option {
+	return func(config *Config) error {
+		config.SweepInterval = interval
+		return nil
+	}
+}
+
+func WithIndexType(t IndexType) Option {
+	return func(config *Config) error {
+		config.IndexType = t
+		return nil
+	}
+}
+
+// WithChecksum checksum algorithm of newly written records. Every record carries its own
+// algorithm, so a database may be reopened with a different choice.
+func WithChecksum(c ChecksumType) Option {
+	return func(config *Config) error {
+		if c != ChecksumIEEE && c != ChecksumCRC32C {
+			return ErrInvalidChecksumType
+		}
+		config.Checksum = c
+		return nil
+	}
+}
+
+// WithReadOnly open an existing database read-only with a shared lock. Every datafile is opened
+// read-only and no merge runs, Put, Delete and merge return ErrReadOnly, and the directory
+// is left untouched after Close.
+func WithReadOnly() Option {
+	return func(config *Config) error {
+		config.ReadOnly = true
+		return nil
+	}
+}
+
+// WithSyncAlways fsync after every write, Put returns once the write is on disk
+func WithSyncAlways() Option {
+	return func(config *Config) error {
+		config.SyncMode = SyncAlways
+		return nil
+	}
+}
+
+// WithGroupCommit concurrent writers share one fsync, waiting up to maxWait for others to join,
+// Put returns once the fsync covering its write is done
+func WithGroupCommit(maxWait time.Duration) Option {
+	return func(config *Config) error {
+		if maxWait < 0 {
+			return ErrInvalidSyncOption
+		}
+		config.SyncMode = SyncGroup
+		config.GroupCommitWait = maxWait
+		return nil
+	}
+}
+
+// WithPeriodicSync fsync the active file in background every interval,
+// writes within the last interval may be lost in a crash
+func WithPeriodicSync(interval time.Duration) Option {
+	return func(config *Config) error {
+		if interval <= 0 {
+			return ErrInvalidSyncOption
+		}
+		config.SyncMode = SyncPeriodic
+		config.SyncInterval = interval
+		return nil
+	}
+}
+
+// WithRecoveryHandler report the torn tail of the active datafile discarded on open,
+// it is logged if no handler is set
+func WithRecoveryHandler(fn func(TailRecovery)) Option {
+	return func(config *Config) error {
+		config.OnRecover = fn
+		return nil
+	}
+}
+
+// WithMergeProgress report progress and result of every merge, including background merges
+func WithMergeProgress(fn func(MergeProgress)) Option {
+	return func(config *Config) error {
+		config.MergeProgress = fn
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+package bitcask
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	"github.com/zach030/tiny-bitcask/internal/index"
+)
+
+// maxGroupSize 一组写请求编码后的最大字节数
+const maxGroupSize = 1 << 20
+
+// writeReq 写入管道中的单个写请求
+type writeReq struct {
+	mode      internal.Mode
+	key       []byte
+	value     []byte
+	expiredAt int64
+	done      chan error
+}
+
+// size 编码后的记录大小
+func (r *writeReq) size() int64 {
+	return int64(internal.EntryHeaderSize + len(r.key) + len(r.value))
+}
+
+// submit 将写请求交给写入管道，等待所在的一组请求写入完成
+func (b *BitCask) submit(mode internal.Mode, key, value []byte, expiredAt int64) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	req := &writeReq{
+		mode:      mode,
+		key:       key,
+		value:     value,
+		expiredAt: expiredAt,
+		done:      make(chan error, 1),
+	}
+	select {
+	case b.writes <- req:
+	case <-b.done:
+		return ErrDatabaseClosed
+	}
+	return <-req.done
+}
+
+// pipeline 后台写入协程，将并发的写请求合并为一次追加写入，开启同步时只做一次fsync
+func (b *BitCask) pipeline() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case req := <-b.writes:
+			b.commitGroup(b.collect(req))
+		}
+	}
+}
+
+// collect 以第一个请求开始收集一组请求，组提交模式下最多等待GroupCommitWait，
+// 其他模式只取出已经排队的请求
+func (b *BitCask) collect(first *writeReq) []*writeReq {
+	group := []*writeReq{first}
+	limit := b.config.MaxFileSize
+	if limit <= 0 || limit > maxGroupSize {
+		limit = maxGroupSize
+	}
+	size := first.size()
+	var timeout <-chan time.Time
+	if b.config.SyncMode == SyncGroup && b.config.GroupCommitWait > 0 {
+		timer := time.NewTimer(b.config.GroupCommitWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for size < limit {
+		var req *writeReq
+		if timeout == nil {
+			select {
+			case req = <-b.writes:
+			default:
+				return group
+			}
+		} else {
+			select {
+			case req = <-b.writes:
+			case <-timeout:
+				return group
+			}
+		}
+		group = append(group, req)
+		size += req.size()
+	}
+	return group
+}
+
+// commitGroup 一次写入整组记录并按顺序更新内存索引，每个请求得到同样的写入结果；
+// 关闭时管道中可能还有已取出的请求，数据库关闭后不再写入
+func (b *BitCask) commitGroup(group []*writeReq) {
+	var err error
+	b.lock.Lock()
+	if atomic.LoadInt32(&b.closed) == 1 {
+		err = ErrDatabaseClosed
+	} else {
+		err = b.appendGroup(group)
+	}
+	b.lock.Unlock()
+	for _, req := range group {
+		req.done <- err
+	}
+}
+
+// appendGroup 为整组记录分配序号后追加到活跃文件，整组只做一次fsync，落盘后才更新内存索引，调用方需持有写锁
+func (b *BitCask) appendGroup(group []*writeReq) error {
+	if err := b.rotate(); err != nil {
+		return err
+	}
+	entries := make([]*internal.Entry, len(group))
+	for i, req := range group {
+		entries[i] = b.newEntry(req.key, req.value, req.mode, b.nextSeq(), req.expiredAt)
+	}
+	offsets, err := b.curr.WriteAll(entries)
+	if err != nil {
+		return err
+	}
+	if err = b.syncActive(); err != nil {
+		return err
+	}
+	for i, req := range group {
+		b.metadata.Append(b.curr.FileID(), int64(entries[i].Size()), entries[i].Seq(), req.mode == internal.ModePut)
+		b.reclaimDetect(req.key)
+		if req.mode == internal.ModeDelete {
+			b.indexer.Delete(req.key)
+			continue
+		}
+		item := index.NewItem(b.curr.FileID(), offsets[i], entries[i].Size())
+		item.ExpiredAt = req.expiredAt
+		item.Seq = entries[i].Seq()
+		b.indexer.Add(req.key, item)
+	}
+	return nil
+}
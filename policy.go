@@ -0,0 +1,192 @@
+package bitcask
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// MergePolicy decides which datafiles are merged and when background merge runs.
+// An explicit Merge call ignores the thresholds, windows and cooldown, but still merges only
+// the datafiles reaching MinGarbageRatio and honors RateLimit.
+type MergePolicy struct {
+	MinGarbageRatio float64       // a datafile is merged only if the ratio of its stale bytes reaches it, in (0, 1]
+	MinDeadBytes    int64         // background merge starts once stale bytes of such datafiles exceed it
+	Windows         []MergeWindow // background merge only runs inside these windows, empty means any time
+	Cooldown        time.Duration // minimum interval between the end of a merge and the next background merge
+	RateLimit       int64         // bytes per second read and written by merge, 0 means unlimited
+}
+
+// MergeWindow time-of-day range in local time, as offsets from midnight. End before Start
+// means the window wraps past midnight, e.g. {22 * time.Hour, 6 * time.Hour}.
+type MergeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// valid 检查策略取值
+func (p MergePolicy) valid() bool {
+	if p.MinGarbageRatio <= 0 || p.MinGarbageRatio > 1 || p.MinDeadBytes < 0 || p.Cooldown < 0 || p.RateLimit < 0 {
+		return false
+	}
+	for _, w := range p.Windows {
+		if w.Start < 0 || w.Start >= day || w.End < 0 || w.End >= day || w.Start == w.End {
+			return false
+		}
+	}
+	return true
+}
+
+// schedule 计算后台合并还需等待的时间，以及合并可以持续的时间（为0时不限制）：
+// 冷却期内等待冷却结束，不在任何时间段内时等待最近的时间段开始
+func (p MergePolicy) schedule(now, lastMerge time.Time) (wait, remain time.Duration) {
+	if !lastMerge.IsZero() {
+		if d := lastMerge.Add(p.Cooldown).Sub(now); d > 0 {
+			return d, 0
+		}
+	}
+	if len(p.Windows) == 0 {
+		return 0, 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	wait = day
+	for _, w := range p.Windows {
+		if w.contains(offset) {
+			// 重叠的时间段取最晚的结束时间
+			if d := (w.End - offset + day) % day; d > remain {
+				remain = d
+			}
+			continue
+		}
+		if d := (w.Start - offset + day) % day; d < wait {
+			wait = d
+		}
+	}
+	if remain > 0 {
+		return 0, remain
+	}
+	return wait, 0
+}
+
+// contains 距离零点offset的时刻是否在时间段内
+func (w MergeWindow) contains(offset time.Duration) bool {
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// needMergeDetect 可回收的字节超过下限时通知后台合并，调用方需持有锁
+func (b *BitCask) needMergeDetect() {
+	policy := b.config.MergePolicy
+	// 所有文件的无效字节都不够时不必逐个文件统计
+	if b.metadata.ReclaimSpace <= policy.MinDeadBytes {
+		return
+	}
+	if b.metadata.Reclaimable(policy.MinGarbageRatio) > policy.MinDeadBytes {
+		select {
+		case b.needMerge <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stat 后台合并：收到合并通知后按策略等待冷却结束、进入允许的时间段，
+// 等待期间统计可能已经变化，开始前重新检查；时间段结束时未完成的合并被取消
+func (b *BitCask) stat() {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-b.done:
+			return
+		case _, ok := <-b.needMerge:
+			if !ok {
+				return
+			}
+		case <-retry:
+		}
+		retry = nil
+		wait, remain := b.config.MergePolicy.schedule(time.Now(), b.lastMergeTime())
+		if wait > 0 {
+			retry = time.After(wait)
+			continue
+		}
+		b.lock.RLock()
+		policy := b.config.MergePolicy
+		ok := b.metadata.Reclaimable(policy.MinGarbageRatio) > policy.MinDeadBytes
+		b.lock.RUnlock()
+		if !ok {
+			continue
+		}
+		// 合并失败不退出，错误通过合并进度回调报告，没有设置回调时写入日志，等待下一次触发
+		if err := b.backgroundMerge(remain); err != nil && b.config.MergeProgress == nil {
+			select {
+			case <-b.done:
+				// 关闭时取消的合并不必记录
+			default:
+				log.Printf("bitcask: background merge of %s failed: %v", b.path, err)
+			}
+		}
+	}
+}
+
+// backgroundMerge 执行一次后台合并，超过remain或数据库关闭时取消
+func (b *BitCask) backgroundMerge(remain time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	if remain > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), remain)
+	}
+	defer cancel()
+	go func() {
+		select {
+		case <-b.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return b.merge(ctx)
+}
+
+// lastMergeTime 上一次合并结束的时间
+func (b *BitCask) lastMergeTime() time.Time {
+	if n := atomic.LoadInt64(&b.lastMerge); n > 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// rateLimiter 限制合并读写的字节速率，按累计字节数计算应当经过的时间
+type rateLimiter struct {
+	rate  int64 // bytes per second, 0 means unlimited
+	start time.Time
+	bytes int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait 累计n个字节，超出速率时等待，ctx取消时返回
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.bytes += int64(n)
+	due := l.start.Add(time.Duration(float64(l.bytes) / float64(l.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,127 @@
+package bitcask
+
+import (
+	"sort"
+	"time"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	df "github.com/zach030/tiny-bitcask/internal/datafile"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+// Snapshot a read-only view of the database as of its creation, the data files its
+// keys point to are pinned so merge doesn't remove them until the snapshot is closed.
+type Snapshot struct {
+	db     *BitCask
+	index  map[string]internal.Item // 创建时的内存索引副本
+	files  map[int]df.DataFile      // 快照独立打开的只读数据文件
+	now    int64                    // 创建时间，用于判断过期
+	closed bool
+}
+
+// Snapshot Create a point-in-time snapshot, Close must be called to release it.
+func (b *BitCask) Snapshot() (*Snapshot, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	index := b.indexer.Index()
+	s := &Snapshot{
+		db:    b,
+		index: index,
+		files: make(map[int]df.DataFile),
+		now:   time.Now().UnixNano(),
+	}
+	// 只固定索引引用到的文件，其余文件不影响合并
+	fids := make(map[int]struct{})
+	for _, item := range index {
+		fids[item.FileID] = struct{}{}
+	}
+	// 单独打开只读文件，活跃文件切换或关闭时不影响快照读取
+	for fid := range fids {
+		f, err := df.NewBkFile(b.path, fid, false)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.files[fid] = f
+	}
+	for fid := range s.files {
+		b.pins[fid]++
+	}
+	return s, nil
+}
+
+// Get Retrieve a value by key as of the snapshot creation.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+	item, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrSpecifyKeyNotExist
+	}
+	return readValue(s.files[item.FileID], item)
+}
+
+// Has if the key is existed as of the snapshot creation
+func (s *Snapshot) Has(key []byte) bool {
+	if s.closed {
+		return false
+	}
+	_, ok := s.lookup(key)
+	return ok
+}
+
+// Fold over all keys in snapshot in sorted order.
+func (s *Snapshot) Fold(f func(key []byte) error) error {
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	keys := make([]string, 0, len(s.index))
+	for key, item := range s.index {
+		if !item.IsExpired(s.now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := f(utils.Str2Bytes(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close release the snapshot and unpin its data files.
+func (s *Snapshot) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.db.lock.Lock()
+	for fid := range s.files {
+		if s.db.pins[fid]--; s.db.pins[fid] <= 0 {
+			delete(s.db.pins, fid)
+		}
+	}
+	s.db.lock.Unlock()
+	return s.closeFiles()
+}
+
+// lookup 查询快照索引，以快照创建时间判断是否过期
+func (s *Snapshot) lookup(key []byte) (internal.Item, bool) {
+	item, ok := s.index[utils.Byte2Str(key)]
+	if !ok || item.IsExpired(s.now) {
+		return internal.Item{}, false
+	}
+	return item, true
+}
+
+func (s *Snapshot) closeFiles() error {
+	var err error
+	for _, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package bitcask
+
+import (
+	"time"
+)
+
+// SyncMode durability guarantee of writes
+type SyncMode uint8
+
+const (
+	// SyncNone writes are left in the OS page cache, a crash of the machine may lose any write
+	// not yet flushed by the OS. Put returns right after the write is handed to the OS.
+	SyncNone SyncMode = iota
+	// SyncAlways every write is fsynced before Put returns, no acknowledged write is lost.
+	SyncAlways
+	// SyncGroup concurrent Put and Delete share one fsync, the first writer waits up to
+	// GroupCommitWait for others to join. Put returns only after the fsync covering its write,
+	// no acknowledged write is lost. Batches and transactions are fsynced on their own.
+	SyncGroup
+	// SyncPeriodic the active file is fsynced in background every SyncInterval, Put returns
+	// right after the write, writes within the last interval may be lost in a crash.
+	SyncPeriodic
+)
+
+// write 在写锁内执行写入，写入需按同步模式在更新内存索引前落盘
+func (b *BitCask) write(fn func() error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return fn()
+}
+
+// syncActive SyncAlways与SyncGroup模式下将活跃文件落盘，写入落盘后才能更新内存索引，
+// 读到的数据不会在宕机后丢失，调用方需持有写锁
+func (b *BitCask) syncActive() error {
+	if b.config.SyncMode == SyncAlways || b.config.SyncMode == SyncGroup {
+		return b.curr.Sync()
+	}
+	return nil
+}
+
+// syncLoop 后台定期将活跃文件落盘
+func (b *BitCask) syncLoop() {
+	ticker := time.NewTicker(b.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.Sync()
+		}
+	}
+}
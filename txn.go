@@ -0,0 +1,124 @@
+package bitcask
+
+import (
+	"github.com/zach030/tiny-bitcask/internal"
+)
+
+// Txn a transaction, it sees its own uncommitted writes, and the writes are applied
+// atomically on commit only if no key it read was changed by others meanwhile.
+type Txn struct {
+	db       *BitCask
+	writable bool
+	reads    map[string]readRecord // key read from db and the version observed
+	writes   map[string]int        // key written in txn and its index in ops
+	ops      []batchOp
+}
+
+// readRecord version of key observed by txn
+type readRecord struct {
+	exists bool
+	seq    uint64
+}
+
+// Update Run fn in a read-write transaction, the transaction is committed if fn returns nil,
+// ErrConflict is returned if any key read in fn was changed before commit.
+func (b *BitCask) Update(fn func(tx *Txn) error) error {
+	tx := b.newTxn(true)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// View Run fn in a read-only transaction.
+func (b *BitCask) View(fn func(tx *Txn) error) error {
+	return fn(b.newTxn(false))
+}
+
+func (b *BitCask) newTxn(writable bool) *Txn {
+	return &Txn{
+		db:       b,
+		writable: writable,
+		reads:    make(map[string]readRecord),
+		writes:   make(map[string]int),
+	}
+}
+
+// Get Retrieve a value by key, uncommitted writes in txn are visible.
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	if i, ok := tx.writes[string(key)]; ok {
+		op := tx.ops[i]
+		if op.mode == internal.ModeDelete {
+			return nil, ErrSpecifyKeyNotExist
+		}
+		return op.value, nil
+	}
+	tx.db.lock.RLock()
+	defer tx.db.lock.RUnlock()
+	item, ok := tx.db.lookup(key)
+	// 只记录第一次读到的版本
+	if _, read := tx.reads[string(key)]; !read {
+		tx.reads[string(key)] = readRecord{exists: ok, seq: item.Seq}
+	}
+	if !ok {
+		return nil, ErrSpecifyKeyNotExist
+	}
+	return tx.db.read(item)
+}
+
+// Put Store a key and value in txn.
+func (tx *Txn) Put(key, value []byte) error {
+	if !tx.writable {
+		return ErrTxnReadOnly
+	}
+	if err := tx.db.validKV(key, value); err != nil {
+		return err
+	}
+	tx.write(batchOp{
+		mode:  internal.ModePut,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+	return nil
+}
+
+// Delete a key in txn.
+func (tx *Txn) Delete(key []byte) error {
+	if !tx.writable {
+		return ErrTxnReadOnly
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	tx.write(batchOp{
+		mode: internal.ModeDelete,
+		key:  append([]byte(nil), key...),
+	})
+	return nil
+}
+
+// write 同一个key多次写入时只保留最后一次
+func (tx *Txn) write(op batchOp) {
+	if i, ok := tx.writes[string(op.key)]; ok {
+		tx.ops[i] = op
+		return
+	}
+	tx.writes[string(op.key)] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+}
+
+// commit 在写锁内校验读过的key版本未变化，再以批量方式写入
+func (tx *Txn) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	return tx.db.write(func() error {
+		for key, rec := range tx.reads {
+			item, ok := tx.db.lookup([]byte(key))
+			if ok != rec.exists || item.Seq != rec.seq {
+				return ErrConflict
+			}
+		}
+		return tx.db.writeBatch(tx.ops)
+	})
+}
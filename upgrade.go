@@ -0,0 +1,252 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/zach030/tiny-bitcask/internal"
+	df "github.com/zach030/tiny-bitcask/internal/datafile"
+	"github.com/zach030/tiny-bitcask/utils"
+)
+
+// v0HeaderSize 最初版本的记录头：crc | timestamp | key-size | value-size，crc只覆盖value，没有操作类型与序号
+const v0HeaderSize = 20
+
+// isV0 目录中既没有元数据文件也没有序号文件时，按第一条记录判断是否是最初版本创建的数据库：
+// 按当前格式校验通过的是丢失了元数据文件的当前版本，只有按最初版本的格式校验通过才需要升级，
+// 两种都不通过的留给正常打开报告损坏
+func isV0(path string) (bool, error) {
+	if utils.Exist(filepath.Join(path, MetaFile)) || utils.Exist(filepath.Join(path, SeqFile)) {
+		return false, nil
+	}
+	fns, err := utils.GetDataFiles(path)
+	if err != nil {
+		return false, err
+	}
+	fids, err := utils.GetDataFileIDs(fns)
+	if err != nil {
+		return false, err
+	}
+	sort.Ints(fids)
+	for _, fid := range fids {
+		name := filepath.Join(path, fmt.Sprintf(df.DefaultBkFileName, fid))
+		buf, err := readFirstRecord(name, internal.EntryHeaderSize)
+		if err != nil {
+			return false, err
+		}
+		// 空文件看不出格式
+		if len(buf) == 0 {
+			continue
+		}
+		if e, err := internal.Decode(buf); err == nil && e.IsValid() {
+			return false, nil
+		}
+		if buf, err = readFirstRecord(name, v0HeaderSize); err != nil {
+			return false, err
+		}
+		_, _, _, err = decodeV0(buf)
+		return err == nil, nil
+	}
+	return false, nil
+}
+
+// readFirstRecord 读取文件的第一条记录，两种格式的key-size与value-size都位于记录头的12到20字节；
+// 记录头声明的大小超过文件时只读到文件末尾，由解码报告不完整
+func readFirstRecord(name string, headerSize int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size > headerSize {
+		header := make([]byte, headerSize)
+		if _, err = f.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+		keySize, valueSize := internal.DecodeHeader(header)
+		if n := headerSize + int64(keySize) + int64(valueSize); n < size {
+			size = n
+		}
+	}
+	buf := make([]byte, size)
+	if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// v0Record 最初版本的一条记录
+type v0Record struct {
+	key, value []byte
+	fid        int
+	offset     int64
+}
+
+// readV0 按文件id顺序读取最初版本的全部记录。最后一个文件末尾不完整的记录是宕机时写了一半的，直接丢弃；
+// 其他位置的损坏记录返回*ErrCorruptEntry
+func readV0(path string, fids []int) ([]v0Record, error) {
+	var records []v0Record
+	for i, fid := range fids {
+		buf, err := ioutil.ReadFile(filepath.Join(path, fmt.Sprintf(df.DefaultBkFileName, fid)))
+		if err != nil {
+			return nil, err
+		}
+		var offset int64
+		for offset < int64(len(buf)) {
+			key, value, size, err := decodeV0(buf[offset:])
+			if err != nil {
+				if i == len(fids)-1 && offset+size >= int64(len(buf)) {
+					break
+				}
+				return nil, &ErrCorruptEntry{FileID: fid, Offset: offset, Err: err}
+			}
+			records = append(records, v0Record{key: key, value: value, fid: fid, offset: offset})
+			offset += size
+		}
+	}
+	return records, nil
+}
+
+// decodeV0 解析最初版本的记录，返回记录头声明的大小，记录头不完整时为剩余的全部字节
+func decodeV0(buf []byte) (key, value []byte, size int64, err error) {
+	if len(buf) < v0HeaderSize {
+		return nil, nil, int64(len(buf)), ErrTruncatedEntry
+	}
+	keySize := uint64(binary.LittleEndian.Uint32(buf[12:16]))
+	valueSize := uint64(binary.LittleEndian.Uint32(buf[16:20]))
+	n := v0HeaderSize + keySize + valueSize
+	if n > uint64(len(buf)) {
+		return nil, nil, int64(len(buf)), ErrTruncatedEntry
+	}
+	key = buf[v0HeaderSize : v0HeaderSize+keySize]
+	value = buf[v0HeaderSize+keySize : n]
+	if binary.LittleEndian.Uint32(buf[0:4]) != crc32.ChecksumIEEE(value) {
+		return nil, nil, int64(n), ErrInvalidCheckSum
+	}
+	return key, value, int64(n), nil
+}
+
+// readV0Index 读取最初版本关闭时保存的gob编码的索引文件，不存在时返回nil
+func readV0Index(path string) (map[string]internal.Item, error) {
+	f, err := os.Open(filepath.Join(path, IndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	index := make(map[string]internal.Item)
+	if err = gob.NewDecoder(f).Decode(&index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// upgradeV0 将最初版本的数据重写为当前格式：存在索引文件时它是哪些记录有效的唯一依据
+// （最初版本只在关闭时保存索引，重新打开时不重放数据文件）；没有索引文件时按顺序重放，
+// 最初版本的删除记录是value为空的记录。有效的key按顺序分配序号写入合并目录，连同元数据一起
+// 作为一次合并切换，宕机后重新打开时按合并清单完成切换或重新升级
+func (b *BitCask) upgradeV0() error {
+	fns, err := utils.GetDataFiles(b.path)
+	if err != nil {
+		return err
+	}
+	fids, err := utils.GetDataFileIDs(fns)
+	if err != nil {
+		return err
+	}
+	sort.Ints(fids)
+	records, err := readV0(b.path, fids)
+	if err != nil {
+		return err
+	}
+	index, err := readV0Index(b.path)
+	if err != nil {
+		return err
+	}
+	live := make(map[string][]byte)
+	for _, r := range records {
+		switch item, ok := index[string(r.key)]; {
+		case index != nil:
+			if ok && item.FileID == r.fid && item.ValuePos == r.offset {
+				live[string(r.key)] = r.value
+			}
+		case len(r.value) == 0:
+			delete(live, string(r.key))
+		default:
+			live[string(r.key)] = r.value
+		}
+	}
+	keys := make([]string, 0, len(live))
+	for key := range live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mergePath := filepath.Join(b.path, MergeTmpFolder)
+	if err = os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(mergePath, 0700); err != nil {
+		return err
+	}
+	m := &mergeManifest{Merged: fids, Phase: mergePhaseRemove}
+	var f df.DataFile
+	for _, key := range keys {
+		if f == nil || f.Size() >= b.config.MaxFileSize {
+			// 关闭时落盘
+			if f != nil {
+				if err = f.Close(); err != nil {
+					return err
+				}
+			}
+			fid := len(m.Files)
+			if f, err = df.NewBkFile(mergePath, fid, true); err != nil {
+				return err
+			}
+			m.Files = append(m.Files, fmt.Sprintf(df.DefaultBkFileName, fid))
+		}
+		if _, _, err = f.Write(b.newEntry([]byte(key), live[key], internal.ModePut, b.nextSeq(), 0)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if f != nil {
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+	meta := &dbMeta{Version: FormatVersion, Config: newMetaConfig(b.config), Seq: b.seq}
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = utils.WriteFileAtomic(filepath.Join(mergePath, MetaFile), buf, 0600); err != nil {
+		return err
+	}
+	m.Files = append(m.Files, MetaFile)
+	if err = writeMergeManifest(mergePath, m); err != nil {
+		return err
+	}
+	if err = b.switchMerge(mergePath, m); err != nil {
+		return err
+	}
+	if err = os.Remove(filepath.Join(b.path, IndexFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
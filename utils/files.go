@@ -41,3 +41,50 @@ func Exist(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
+
+// ParseFileID 解析数据文件或hint文件名中的文件id
+func ParseFileID(name string) (int, bool) {
+	ext := filepath.Ext(name)
+	if ext != ".data" && ext != ".hint" {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ext))
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// SyncDir 将目录项的变更落盘，保证文件的创建、删除与重命名在宕机后依然有效
+func SyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// WriteFileAtomic 写入临时文件并落盘后重命名为path，再将目录项落盘，宕机后path要么是旧内容要么是完整的新内容
+func WriteFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	tmpPath := path + "-tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}